@@ -47,6 +47,62 @@ func NewCompactor(consulAddr string, logger log.Logger) (compactor.Service, erro
 		retry := lb.Retry(retryMax, retryTimeout, balancer)
 		endpoints.ProcessEndpoint = retry
 	}
+	{
+		factory := factoryForCompactor(compactor.MakeRollupEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.RollupEndpoint = retry
+	}
+	{
+		factory := factoryForCompactor(compactor.MakeCheckpointsEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.CheckpointsEndpoint = retry
+	}
+	{
+		factory := factoryForCompactor(compactor.MakeSubmitJobEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.SubmitJobEndpoint = retry
+	}
+	{
+		factory := factoryForCompactor(compactor.MakeGetJobEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.GetJobEndpoint = retry
+	}
+	{
+		factory := factoryForCompactor(compactor.MakeCancelJobEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.CancelJobEndpoint = retry
+	}
+	{
+		factory := factoryForCompactor(compactor.MakeDeadLettersEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.DeadLettersEndpoint = retry
+	}
+	{
+		factory := factoryForCompactor(compactor.MakeRetryDeadLetterEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.RetryDeadLetterEndpoint = retry
+	}
+	{
+		factory := factoryForCompactor(compactor.MakeDiscardDeadLetterEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.DiscardDeadLetterEndpoint = retry
+	}
 
 	return endpoints, nil
 }
@@ -54,6 +54,34 @@ func NewCounter(consulAddr string, logger log.Logger) (counter.Service, error) {
 		retry := lb.Retry(retryMax, retryTimeout, balancer)
 		endpoints.StopEndpoint = retry
 	}
+	{
+		factory := factoryForCounter(counter.MakeStartBatchEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.StartBatchEndpoint = retry
+	}
+	{
+		factory := factoryForCounter(counter.MakeStopBatchEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.StopBatchEndpoint = retry
+	}
+	{
+		factory := factoryForCounter(counter.MakeRecordEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.RecordEndpoint = retry
+	}
+	{
+		factory := factoryForCounter(counter.MakeKeysEndpoint)
+		endpointer := sd.NewEndpointer(instancer, factory, logger)
+		balancer := lb.NewRoundRobin(endpointer)
+		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		endpoints.KeysEndpoint = retry
+	}
 
 	return endpoints, nil
 }
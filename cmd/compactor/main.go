@@ -12,7 +12,7 @@ import (
 
 func main() {
 	name := "compactor"
-	app := pkg.NewApp(name, pkg.ConfigureHTTP(), pkg.ConfigureRedis(), pkg.ConfigureMongo())
+	app := pkg.NewApp(name, pkg.ConfigureHTTP(), pkg.ConfigureRedis(), pkg.ConfigureMongo(), pkg.ConfigureRetention(), pkg.ConfigureLookback(), pkg.ConfigureConcurrency(), pkg.ConfigureBatchSize(), pkg.ConfigureMaxFailures())
 
 	var s compactor.Service
 	{
@@ -30,13 +30,31 @@ func main() {
 		t := time.NewTicker(time.Minute)
 		defer t.Stop()
 		for {
+			// process right away to catch up after a downtime.
+			res, err := s.Process(ctx, compactor.ProcessRequest{StartAt: time.Now().UTC()})
+			if err != nil {
+				app.ErrorLog("err", err.Error())
+			}
+
+			if res != nil {
+				app.Logger.Log(
+					"msg", "processed",
+					"segments", res.Segments,
+					"merged_src", res.Merged[pkg.DirectionSrc],
+					"merged_dst", res.Merged[pkg.DirectionDst],
+					"functions", res.Functions,
+					"duration", res.Duration,
+					"requeued", res.Requeued,
+					"dead_lettered", res.DeadLettered,
+					"elapsed", res.Elapsed,
+					"oldest_segment", res.OldestSegment,
+				)
+			}
+
 			select {
 			case <-ctx.Done():
 				return
 			case <-t.C:
-				if err := s.Process(ctx, compactor.ProcessRequest{StartAt: time.Now().UTC()}); err != nil {
-					app.ErrorLog("err", err.Error())
-				}
 			}
 		}
 	}()
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/ropelive/count/pkg"
@@ -10,7 +11,7 @@ import (
 
 func main() {
 	name := "counter"
-	app := pkg.NewApp(name, pkg.ConfigureHTTP(), pkg.ConfigureRedis())
+	app := pkg.NewApp(name, pkg.ConfigureHTTP(), pkg.ConfigureRedis(), pkg.ConfigureLatencyBuckets(), pkg.ConfigureTokens(), pkg.ConfigureSigningKeys(), pkg.ConfigureLabels())
 
 	var s counter.Service
 	{
@@ -23,5 +24,11 @@ func main() {
 		h = counter.MakeHTTPHandler(s, log.With(app.Logger, "component", "HTTP"))
 	}
 
+	done := make(chan struct{})
+	go app.Tenants().Watch(time.Minute, done, func(err error) {
+		app.ErrorLog("msg", "could not reload the signing keys", "err", err.Error())
+	})
+
 	app.Logger.Log("exit", <-app.Listen(h))
+	close(done)
 }
@@ -5,7 +5,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -19,8 +22,17 @@ type App struct {
 	redis  *redis.RedisSession
 	mongo  *mongodb.MongoDB
 
-	name     string
-	httpAddr *string
+	name        string
+	httpAddr    *string
+	buckets     []time.Duration
+	tokens      *TokenConfig
+	tenants     *Tenants
+	labels      *LabelConfig
+	retention   RetentionConfig
+	lookback    time.Duration
+	workers     int
+	batchSize   int
+	maxFailures int
 }
 
 // NewApp creates a new App context for the system.
@@ -65,6 +77,100 @@ func (a *App) MustGetMongo() *mongodb.MongoDB {
 	return a.mongo
 }
 
+// LatencyBuckets returns the configured latency bucket upper bounds. If they
+// are not configured, returns DefaultLatencyBuckets.
+func (a *App) LatencyBuckets() []time.Duration {
+	if a.buckets == nil {
+		return DefaultLatencyBuckets
+	}
+	return a.buckets
+}
+
+// TokenConfig returns the configured token settings. If they are not
+// configured, returns DefaultTokenConfig.
+func (a *App) TokenConfig() TokenConfig {
+	if a.tokens == nil {
+		return DefaultTokenConfig
+	}
+	return *a.tokens
+}
+
+// Tenants returns the configured tenants and their signing keys. If they are
+// not configured, returns only the default tenant with DefaultSigningKey.
+func (a *App) Tenants() *Tenants {
+	if a.tenants == nil {
+		return defaultTenants
+	}
+	return a.tenants
+}
+
+// LabelConfig returns the configured label settings. If they are not
+// configured, returns DefaultLabelConfig.
+func (a *App) LabelConfig() LabelConfig {
+	if a.labels == nil {
+		return DefaultLabelConfig
+	}
+	return *a.labels
+}
+
+// Retention returns the configured retentions of the compaction documents.
+func (a *App) Retention() RetentionConfig {
+	if a.retention == nil {
+		return DefaultRetentionConfig
+	}
+	return a.retention
+}
+
+// DefaultLookback is how far back the compactor looks for the segments when
+// the lookback is not configured.
+const DefaultLookback = time.Hour
+
+// Lookback returns how far back the compactor looks for the segments.
+func (a *App) Lookback() time.Duration {
+	if a.lookback == 0 {
+		return DefaultLookback
+	}
+	return a.lookback
+}
+
+// DefaultConcurrency is the number of the compactor workers when the
+// concurrency is not configured.
+const DefaultConcurrency = 4
+
+// Concurrency returns the number of the compactor workers.
+func (a *App) Concurrency() int {
+	if a.workers == 0 {
+		return DefaultConcurrency
+	}
+	return a.workers
+}
+
+// DefaultBatchSize is the number of the members that a compactor worker claims
+// at once when the batch size is not configured.
+const DefaultBatchSize = 100
+
+// BatchSize returns the number of the members that a compactor worker claims
+// at once.
+func (a *App) BatchSize() int {
+	if a.batchSize == 0 {
+		return DefaultBatchSize
+	}
+	return a.batchSize
+}
+
+// DefaultMaxFailures is the number of the failed merges of a member before it
+// is dead-lettered when the max failures is not configured.
+const DefaultMaxFailures = 5
+
+// MaxFailures returns the number of the failed merges of a member before it is
+// dead-lettered.
+func (a *App) MaxFailures() int {
+	if a.maxFailures == 0 {
+		return DefaultMaxFailures
+	}
+	return a.maxFailures
+}
+
 // Opts configures the application
 type Opts func(*App) error
 
@@ -115,13 +221,249 @@ func ConfigureHTTP() func(*App) error {
 	}
 }
 
+// ConfigureLatencyBuckets configures the latency histogram buckets
+func ConfigureLatencyBuckets() func(*App) error {
+	buckets := os.Getenv("LATENCY_BUCKETS")
+
+	return func(app *App) error {
+		if buckets == "" {
+			return nil
+		}
+
+		var err error
+		app.buckets, err = ParseLatencyBuckets(buckets)
+		if err != nil {
+			return fmt.Errorf("latencybuckets: %s", err)
+		}
+		return nil
+	}
+}
+
+// ConfigureTokens configures the token lifetime and the max call duration. When
+// only one of them is set, ttl is twice the max call duration.
+func ConfigureTokens() func(*App) error {
+	ttl := os.Getenv("TOKEN_TTL")
+	maxCallDur := os.Getenv("MAX_CALL_DURATION")
+	policy := os.Getenv("OVERLONG_CALL_POLICY")
+
+	return func(app *App) error {
+		tokens := DefaultTokenConfig
+
+		var err error
+		if ttl != "" {
+			if tokens.TTL, err = time.ParseDuration(ttl); err != nil {
+				return fmt.Errorf("tokens: %s", err)
+			}
+			tokens.MaxCallDuration = tokens.TTL / 2
+		}
+
+		if maxCallDur != "" {
+			if tokens.MaxCallDuration, err = time.ParseDuration(maxCallDur); err != nil {
+				return fmt.Errorf("tokens: %s", err)
+			}
+
+			if ttl == "" {
+				tokens.TTL = 2 * tokens.MaxCallDuration
+			}
+		}
+
+		if policy != "" {
+			tokens.OverlongPolicy = policy
+		}
+
+		if err := tokens.Validate(); err != nil {
+			return fmt.Errorf("tokens: %s", err)
+		}
+
+		app.tokens = &tokens
+		return nil
+	}
+}
+
+// ConfigureSigningKeys configures the RSA or ECDSA token signing keys either
+// from a key ring directory or from a single PEM file. Removed keys are kept for
+// verifying for the token TTL, so ConfigureTokens should be given before it.
+func ConfigureSigningKeys() func(*App) error {
+	dir := os.Getenv("SIGNING_KEYS_DIR")
+	path := os.Getenv("SIGNING_KEY_FILE")
+	id := os.Getenv("SIGNING_KEY_ID")
+	tenantsDir := os.Getenv("TENANTS_DIR")
+
+	return func(app *App) error {
+		var keys *KeyRing
+		var err error
+		switch {
+		case dir != "":
+			keys, err = LoadKeyRing(dir, app.TokenConfig().TTL)
+		case path != "":
+			var key *SigningKey
+			if key, err = LoadSigningKey(id, path); err == nil {
+				keys = NewKeyRing(key)
+			}
+		default:
+			keys = NewKeyRing(DefaultSigningKey)
+		}
+
+		if err != nil {
+			return fmt.Errorf("signingkeys: %s", err)
+		}
+
+		if app.tenants, err = LoadTenants(keys, tenantsDir, app.TokenConfig().TTL); err != nil {
+			return fmt.Errorf("tenants: %s", err)
+		}
+		return nil
+	}
+}
+
+// ConfigureLabels configures the allowed label keys and the label value cap
+func ConfigureLabels() func(*App) error {
+	keys := os.Getenv("LABEL_KEYS")
+	maxValues := os.Getenv("LABEL_MAX_VALUES")
+
+	return func(app *App) error {
+		labels := DefaultLabelConfig
+
+		for _, key := range strings.Split(keys, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				labels.AllowedKeys = append(labels.AllowedKeys, key)
+			}
+		}
+
+		if maxValues != "" {
+			var err error
+			if labels.MaxValuesPerSegment, err = strconv.Atoi(maxValues); err != nil {
+				return fmt.Errorf("labels: %s", err)
+			}
+		}
+
+		if labels.MaxValuesPerSegment <= 0 {
+			return fmt.Errorf("labels: max values should be positive")
+		}
+
+		app.labels = &labels
+		return nil
+	}
+}
+
+// ConfigureRetention configures how long the compaction documents are kept,
+// eg: RETENTION="segment=336h,hour=2160h". Documents are kept forever by
+// default, zero keeps the documents of a granularity forever too.
+func ConfigureRetention() func(*App) error {
+	retention := os.Getenv("RETENTION")
+
+	return func(app *App) error {
+		if retention == "" {
+			return nil
+		}
+
+		var err error
+		if app.retention, err = ParseRetention(retention); err != nil {
+			return fmt.Errorf("retention: %s", err)
+		}
+
+		return nil
+	}
+}
+
+// ConfigureLookback configures how far back the compactor looks for the
+// segments, eg: LOOKBACK=6h.
+func ConfigureLookback() func(*App) error {
+	lookback := os.Getenv("LOOKBACK")
+
+	return func(app *App) error {
+		if lookback == "" {
+			return nil
+		}
+
+		var err error
+		if app.lookback, err = time.ParseDuration(lookback); err != nil {
+			return fmt.Errorf("lookback: %s", err)
+		}
+
+		if app.lookback <= 0 {
+			return fmt.Errorf("lookback: should be positive")
+		}
+
+		return nil
+	}
+}
+
+// ConfigureConcurrency configures the number of the compactor workers, eg:
+// CONCURRENCY=16.
+func ConfigureConcurrency() func(*App) error {
+	concurrency := os.Getenv("CONCURRENCY")
+
+	return func(app *App) error {
+		if concurrency == "" {
+			return nil
+		}
+
+		var err error
+		if app.workers, err = strconv.Atoi(concurrency); err != nil {
+			return fmt.Errorf("concurrency: %s", err)
+		}
+
+		if app.workers <= 0 {
+			return fmt.Errorf("concurrency: should be positive")
+		}
+
+		return nil
+	}
+}
+
+// ConfigureBatchSize configures the number of the members that a compactor
+// worker claims at once, eg: BATCH_SIZE=500.
+func ConfigureBatchSize() func(*App) error {
+	batchSize := os.Getenv("BATCH_SIZE")
+
+	return func(app *App) error {
+		if batchSize == "" {
+			return nil
+		}
+
+		var err error
+		if app.batchSize, err = strconv.Atoi(batchSize); err != nil {
+			return fmt.Errorf("batch size: %s", err)
+		}
+
+		if app.batchSize <= 0 {
+			return fmt.Errorf("batch size: should be positive")
+		}
+
+		return nil
+	}
+}
+
+// ConfigureMaxFailures configures the number of the failed merges of a member
+// before it is dead-lettered, eg: MAX_FAILURES=3.
+func ConfigureMaxFailures() func(*App) error {
+	maxFailures := os.Getenv("MAX_FAILURES")
+
+	return func(app *App) error {
+		if maxFailures == "" {
+			return nil
+		}
+
+		var err error
+		if app.maxFailures, err = strconv.Atoi(maxFailures); err != nil {
+			return fmt.Errorf("max failures: %s", err)
+		}
+
+		if app.maxFailures <= 0 {
+			return fmt.Errorf("max failures: should be positive")
+		}
+
+		return nil
+	}
+}
+
 // Listen waits for app shutdown.
 func (a *App) Listen(handler http.Handler) chan error {
 	errs := make(chan error)
 
 	// TODO go func is not required here for now, added for future extensibility.
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
@@ -1,8 +1,13 @@
 package pkg
 
 import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -14,12 +19,84 @@ const (
 	issuer = "auther_v1.0"
 )
 
+// ErrTokenExpired is returned when the token's lifetime is over.
+var ErrTokenExpired = errors.New("token is expired")
+
+// Policies for the calls that take longer than the max call duration.
+const (
+	// OverlongReject rejects the call with ErrCallTooLong.
+	OverlongReject = "reject"
+
+	// OverlongClamp records the call with the max call duration.
+	OverlongClamp = "clamp"
+
+	// OverlongTimeout records the call with the max call duration and the
+	// timeout outcome.
+	OverlongTimeout = "timeout"
+)
+
+// ErrCallTooLong is returned when a call takes longer than the max call
+// duration and the overlong policy is reject.
+var ErrCallTooLong = errors.New("call took longer than the max call duration")
+
+// TokenConfig holds the lifetime settings of the tokens.
+type TokenConfig struct {
+	// TTL is the lifetime of the tokens.
+	TTL time.Duration
+
+	// MaxCallDuration is the longest call duration that is recorded as is.
+	MaxCallDuration time.Duration
+
+	// OverlongPolicy is applied to the calls that take longer than
+	// MaxCallDuration.
+	OverlongPolicy string
+}
+
+// DefaultTokenConfig is used when the tokens are not configured.
+var DefaultTokenConfig = TokenConfig{
+	TTL:             2 * time.Hour,
+	MaxCallDuration: time.Hour,
+	OverlongPolicy:  OverlongReject,
+}
+
+// minOverlongGrace is the shortest gap between the max call duration and the
+// ttl. Overlong calls that are stopped in the gap still have valid tokens, so
+// the overlong policy is applied to them.
+const minOverlongGrace = time.Minute
+
+// Validate checks if the config is consistent.
+func (t TokenConfig) Validate() error {
+	if t.TTL <= 0 {
+		return errors.New("ttl should be positive")
+	}
+
+	if t.MaxCallDuration <= 0 || t.TTL-t.MaxCallDuration < minOverlongGrace {
+		return fmt.Errorf("max call duration should be positive and at least %s shorter than ttl", minOverlongGrace)
+	}
+
+	switch t.OverlongPolicy {
+	case OverlongReject, OverlongClamp, OverlongTimeout:
+		return nil
+	default:
+		return fmt.Errorf("invalid overlong policy: %q", t.OverlongPolicy)
+	}
+}
+
 // JWTData holds the data for JWT signing
 type JWTData struct {
 	Source    string
 	Target    string
 	FuncName  string
 	CreatedAt time.Time
+	Labels    map[string]string
+	Tenant    string
+
+	// ID uniquely identifies the token. It is generated while signing.
+	ID string
+
+	// ExpiresAt is the end of the token's lifetime. Zero value means the token
+	// does not expire.
+	ExpiresAt time.Time
 }
 
 // Claim holds authentication claims
@@ -37,6 +114,13 @@ type Claim struct {
 	// IssuedAt does not allow nano secs.
 	CreatedAt int64 `json:"cat"`
 
+	// Labels holds the extra aggregation dimensions of the call.
+	Labels map[string]string `json:"lbl,omitempty"`
+
+	// Tenant holds the namespace of the call. Empty value is the default
+	// tenant.
+	Tenant string `json:"tnt,omitempty"`
+
 	jwt.StandardClaims
 }
 
@@ -54,47 +138,167 @@ func (c *Claim) Valid() error {
 	if c.Fn == "" {
 		return errors.New("fn is not set")
 	}
+	if c.Id == "" {
+		return errors.New("jti is not set")
+	}
+	if err := ValidateTenant(c.Tenant); err != nil {
+		return err
+	}
 	return c.StandardClaims.Valid()
 }
 
 var mySigningKey = []byte("AllYourBaseAreBelongToMe")
 
+// DefaultSigningKey is used when no signing key is configured.
+var DefaultSigningKey = NewHMACKey(mySigningKey)
+
+// SigningKey holds the key material for signing and verifying the tokens.
+type SigningKey struct {
+	// ID is set as the kid header of the signed tokens.
+	ID string
+
+	Method jwt.SigningMethod
+
+	// sign is the private key or the secret, verify is the public key or the
+	// secret.
+	sign   interface{}
+	verify interface{}
+}
+
+// NewHMACKey creates a HS256 signing key with the given secret.
+func NewHMACKey(secret []byte) *SigningKey {
+	return &SigningKey{
+		Method: jwt.SigningMethodHS256,
+		sign:   secret,
+		verify: secret,
+	}
+}
+
+// NewSigningKey creates a signing key from the given RSA or ECDSA private key.
+// RSA keys are used with RS256, ECDSA keys with ES256, ES384 or ES512 based on
+// their curves.
+func NewSigningKey(id string, privateKey interface{}) (*SigningKey, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return &SigningKey{ID: id, Method: jwt.SigningMethodRS256, sign: key, verify: &key.PublicKey}, nil
+	case *ecdsa.PrivateKey:
+		var method jwt.SigningMethod
+		switch key.Curve.Params().BitSize {
+		case 256:
+			method = jwt.SigningMethodES256
+		case 384:
+			method = jwt.SigningMethodES384
+		case 521:
+			method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", key.Curve.Params().Name)
+		}
+		return &SigningKey{ID: id, Method: method, sign: key, verify: &key.PublicKey}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+}
+
+// LoadSigningKey loads a RSA or ECDSA private key from the given PEM file.
+func LoadSigningKey(id, path string) (*SigningKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return NewSigningKey(id, key)
+	}
+
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a RSA nor an ECDSA private key: %s", path, err)
+	}
+
+	return NewSigningKey(id, key)
+}
+
+// PublicKey returns the public key of asymmetric keys, nil otherwise.
+func (k *SigningKey) PublicKey() interface{} {
+	switch k.verify.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return k.verify
+	default:
+		return nil
+	}
+}
+
 // SignJWT signs the given JWTData with the private key.
-func SignJWT(d *JWTData) (string, error) {
+func SignJWT(key *SigningKey, d *JWTData) (string, error) {
+
+	now := time.Now().UTC()
+
+	id, err := generateTokenID()
+	if err != nil {
+		return "", err
+	}
 
 	// Create the Claims
 	claims := &Claim{
 		Src:       d.Source,
 		Tgt:       d.Target,
 		Fn:        d.FuncName,
-		CreatedAt: time.Now().UTC().UnixNano(),
+		CreatedAt: now.UnixNano(),
+		Labels:    d.Labels,
+		Tenant:    d.Tenant,
 		StandardClaims: jwt.StandardClaims{
-			Issuer: issuer, // string iss
+			Issuer:   issuer,     // string iss
+			IssuedAt: now.Unix(), // int64 iat
+			Id:       id,         // string jti
 			// Audience  string aud
-			// ExpiresAt int64  exp
-			// Id        string jti
-			// IssuedAt  int64 iat
 			// NotBefore int64  nbf
 			// Subject   string sub
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(mySigningKey)
+	if !d.ExpiresAt.IsZero() {
+		claims.ExpiresAt = d.ExpiresAt.Unix() // int64 exp
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.sign)
 }
 
 // ParseJWT parses the given JWT and outputs debug log messages based on the
 // validation errors.
-func ParseJWT(logger log.Logger, s string) (*JWTData, error) {
+func ParseJWT(logger log.Logger, keys VerificationKeys, s string) (*JWTData, error) {
 	token, err := jwt.ParseWithClaims(s, &Claim{}, func(token *jwt.Token) (interface{}, error) {
-		return mySigningKey, nil
+		claims, ok := token.Claims.(*Claim)
+		if !ok {
+			return nil, fmt.Errorf("invalid data type in Claims %T", token.Claims)
+		}
+
+		// claims are not verified yet, but the tenant's keys are required
+		// for verifying them.
+		kid, _ := token.Header["kid"].(string)
+		key, err := keys.VerificationKey(claims.Tenant, kid)
+		if err != nil {
+			return nil, err
+		}
+
+		// do not let the token choose the verification method.
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %s", token.Method.Alg())
+		}
+		return key.verify, nil
 	})
 
 	if err != nil {
 		if ve, ok := err.(*jwt.ValidationError); ok {
 			if ve.Errors&jwt.ValidationErrorMalformed != 0 {
 				level.Debug(logger).Log("operation", "ParseJWT", "token", s, "msg", "that's not even a token", "err", err)
-			} else if ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
+			} else if ve.Errors&jwt.ValidationErrorExpired != 0 {
+				level.Debug(logger).Log("operation", "ParseJWT", "token", s, "msg", "token is expired.", "err", err)
+				return nil, ErrTokenExpired
+			} else if ve.Errors&(jwt.ValidationErrorIssuedAt|jwt.ValidationErrorNotValidYet) != 0 {
 				level.Debug(logger).Log("operation", "ParseJWT", "token", s, "msg", "time is not valid.", "err", err)
 			} else {
 				level.Debug(logger).Log("operation", "ParseJWT", "token", s, "msg", "token error.", "err", err)
@@ -113,13 +317,31 @@ func ParseJWT(logger log.Logger, s string) (*JWTData, error) {
 			return nil, fmt.Errorf("invalid data type in Claims %T", token.Claims)
 		}
 
-		return &JWTData{
+		data := &JWTData{
 			Source:    claims.Src,
 			Target:    claims.Tgt,
 			FuncName:  claims.Fn,
 			CreatedAt: time.Unix(0, claims.CreatedAt),
-		}, nil
+			Labels:    claims.Labels,
+			Tenant:    claims.Tenant,
+			ID:        claims.Id,
+		}
+
+		if claims.ExpiresAt != 0 {
+			data.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+		}
+
+		return data, nil
 	}
 
 	return nil, fmt.Errorf("ParseJWT: invalid token, no error for %q", s)
 }
+
+// generateTokenID generates a random token id.
+func generateTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,212 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// errAnyJWT is used in the test cases that expect an error without a
+// sentinel value, eg: the validation errors of the jwt package.
+var errAnyJWT = errors.New("any error")
+
+func TestParseJWT(t *testing.T) {
+	rsaKey, ecKey := generateSigningKeys(t)
+
+	tests := []struct {
+		name      string
+		key       *SigningKey
+		parseKey  *SigningKey
+		expiresAt time.Time
+		wantErr   error
+	}{
+		{
+			name: "token without expiry",
+		},
+		{
+			name:      "valid token",
+			expiresAt: time.Now().Add(time.Hour),
+		},
+		{
+			name:      "expired token",
+			expiresAt: time.Now().Add(-time.Hour),
+			wantErr:   ErrTokenExpired,
+		},
+		{
+			name:      "rsa key",
+			key:       rsaKey,
+			expiresAt: time.Now().Add(time.Hour),
+		},
+		{
+			name:      "ecdsa key",
+			key:       ecKey,
+			expiresAt: time.Now().Add(time.Hour),
+		},
+		{
+			name:     "different signing method",
+			key:      rsaKey,
+			parseKey: ecKey,
+			wantErr:  errAnyJWT,
+		},
+		{
+			name:     "symmetric key can not verify asymmetric tokens",
+			key:      rsaKey,
+			parseKey: NewHMACKey([]byte("secret")),
+			wantErr:  errAnyJWT,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.key == nil {
+				tt.key = DefaultSigningKey
+			}
+			if tt.parseKey == nil {
+				tt.parseKey = tt.key
+			}
+
+			token, err := SignJWT(tt.key, &JWTData{
+				Source:    "src",
+				Target:    "tgt",
+				FuncName:  "fn",
+				ExpiresAt: tt.expiresAt,
+			})
+			if err != nil {
+				t.Fatalf("SignJWT() error = %v", err)
+			}
+
+			data, err := ParseJWT(log.NewNopLogger(), tt.parseKey, token)
+			if tt.wantErr == errAnyJWT && err == nil || tt.wantErr != errAnyJWT && err != tt.wantErr {
+				t.Fatalf("ParseJWT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err == nil && data.ID == "" {
+				t.Errorf("ParseJWT() ID is not set")
+			}
+
+			if err == nil && data.ExpiresAt.Unix() != tt.expiresAt.Unix() && !tt.expiresAt.IsZero() {
+				t.Errorf("ParseJWT() ExpiresAt = %v, want %v", data.ExpiresAt, tt.expiresAt)
+			}
+		})
+	}
+}
+
+func TestTokenConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TokenConfig
+		wantErr bool
+	}{
+		{
+			name:   "default config",
+			config: DefaultTokenConfig,
+		},
+		{
+			name: "max call duration longer than ttl",
+			config: TokenConfig{
+				TTL:             time.Minute,
+				MaxCallDuration: time.Hour,
+				OverlongPolicy:  OverlongClamp,
+			},
+			wantErr: true,
+		},
+		{
+			name: "max call duration as long as ttl",
+			config: TokenConfig{
+				TTL:             time.Hour,
+				MaxCallDuration: time.Hour,
+				OverlongPolicy:  OverlongClamp,
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown policy",
+			config: TokenConfig{
+				TTL:             2 * time.Minute,
+				MaxCallDuration: time.Minute,
+				OverlongPolicy:  "drop",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("TokenConfig.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSigningKey_JWK(t *testing.T) {
+	rsaKey, ecKey := generateSigningKeys(t)
+
+	tests := []struct {
+		name    string
+		key     *SigningKey
+		wantKty string
+		wantAlg string
+		wantOk  bool
+	}{
+		{
+			name:   "symmetric key is not published",
+			key:    DefaultSigningKey,
+			wantOk: false,
+		},
+		{
+			name:    "rsa key",
+			key:     rsaKey,
+			wantKty: "RSA",
+			wantAlg: "RS256",
+			wantOk:  true,
+		},
+		{
+			name:    "ecdsa key",
+			key:     ecKey,
+			wantKty: "EC",
+			wantAlg: "ES256",
+			wantOk:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwk, ok := tt.key.JWK()
+			if ok != tt.wantOk {
+				t.Fatalf("SigningKey.JWK() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if jwk.Kty != tt.wantKty || jwk.Alg != tt.wantAlg {
+				t.Errorf("SigningKey.JWK() = %+v, want kty %v alg %v", jwk, tt.wantKty, tt.wantAlg)
+			}
+			if ok && jwk.Kid != tt.key.ID {
+				t.Errorf("SigningKey.JWK() kid = %v, want %v", jwk.Kid, tt.key.ID)
+			}
+		})
+	}
+}
+
+func generateSigningKeys(t *testing.T) (rsaKey, ecKey *SigningKey) {
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() error = %v", err)
+	}
+
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() error = %v", err)
+	}
+
+	if rsaKey, err = NewSigningKey("rsa", rsaPrivate); err != nil {
+		t.Fatalf("NewSigningKey() error = %v", err)
+	}
+
+	if ecKey, err = NewSigningKey("ec", ecPrivate); err != nil {
+		t.Fatalf("NewSigningKey() error = %v", err)
+	}
+
+	return rsaKey, ecKey
+}
@@ -1,6 +1,8 @@
 package pkg
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -10,8 +12,70 @@ const (
 	// SegmentDur specifies the duration for work segments
 	SegmentDur = 5 * time.Minute
 	seperator  = ":"
+
+	// fieldSeperator splits the function name and the metric name in counter
+	// hash fields.
+	fieldSeperator = "|"
+
+	// NonceField holds the random number that the compactor puts into a
+	// counter hash before merging it. It is not a function metric.
+	NonceField = fieldSeperator + "nonce"
+)
+
+// Metric names are stored next to the function name in the counter hash
+// fields. Duration is stored with the bare function name.
+const (
+	MetricDuration = ""
+	MetricCalls    = "calls"
+	MetricMin      = "min"
+	MetricMax      = "max"
+
+	// MetricBucketPrefix prefixes the latency bucket metrics. The rest of the
+	// metric is the upper bound of the bucket in nano secs or "inf".
+	MetricBucketPrefix = "le_"
+	bucketInf          = "inf"
+
+	// MetricOutcomePrefix prefixes the call outcome tallies, eg: "outcome_error".
+	MetricOutcomePrefix = "outcome_"
+
+	// MetricErrorClassPrefix prefixes the tallies of the failed calls per error
+	// class.
+	MetricErrorClassPrefix = "errclass_"
+)
+
+// Call outcomes
+const (
+	OutcomeSuccess   = "success"
+	OutcomeError     = "error"
+	OutcomeCancelled = "cancelled"
+	OutcomeTimeout   = "timeout"
 )
 
+// maxErrorClassLen limits the length of the error classes.
+const maxErrorClassLen = 64
+
+// MaxErrorClassesPerSegment limits the distinct error classes of a function in
+// a segment. Rest of the classes are recorded as OtherErrorClass.
+const MaxErrorClassesPerSegment = 20
+
+// OtherErrorClass replaces the error classes that are seen after the per
+// segment cap is reached.
+const OtherErrorClass = "_other"
+
+// DefaultLatencyBuckets holds the upper bounds of the latency buckets that are
+// used when no buckets are configured.
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
 // AllKeys holds the redis key names for processings...
 type AllKeys struct {
 	Dst KeyNames
@@ -26,7 +90,12 @@ type KeyNames struct {
 
 // GetCurrentSegment returns the current segment's time
 func GetCurrentSegment() time.Time {
-	return time.Now().UTC().Add(-(SegmentDur / 2)).Round(SegmentDur)
+	return GetSegment(time.Now())
+}
+
+// GetSegment returns the time of the segment that the given time falls in.
+func GetSegment(t time.Time) time.Time {
+	return t.UTC().Add(-(SegmentDur / 2)).Round(SegmentDur)
 }
 
 // GetLastProcessibleSegment return the two previous segment time. We compact the
@@ -36,20 +105,64 @@ func GetLastProcessibleSegment(t time.Time) time.Time {
 	return t.Add(-SegmentDur * 2).Add(-(SegmentDur / 2)).Round(SegmentDur)
 }
 
-// GenerateKeyNames generates the redis key names
-func GenerateKeyNames(tr time.Time) *AllKeys {
+// Counter directions
+const (
+	DirectionSrc = "src"
+	DirectionDst = "dst"
+)
+
+// GenerateKeyNames generates the redis key names of the given tenant. Keys of
+// the default tenant, "", are not prefixed.
+func GenerateKeyNames(tenant string, tr time.Time) *AllKeys {
 	k := &AllKeys{
 		Dst: KeyNames{},
 		Src: KeyNames{},
 	}
 
-	k.Src.CurrentCounterSet = generateSegmentPrefix("set:counter:src", tr)
-	k.Src.CurrentCounterHSet = generateSegmentPrefix("hset:counter:src", tr)
-	k.Dst.CurrentCounterSet = generateSegmentPrefix("set:counter:dst", tr)
-	k.Dst.CurrentCounterHSet = generateSegmentPrefix("hset:counter:dst", tr)
+	prefix := tenantPrefix(tenant)
+	k.Src.CurrentCounterSet = generateSegmentPrefix(prefix+"set:counter:src", tr)
+	k.Src.CurrentCounterHSet = generateSegmentPrefix(prefix+"hset:counter:src", tr)
+	k.Dst.CurrentCounterSet = generateSegmentPrefix(prefix+"set:counter:dst", tr)
+	k.Dst.CurrentCounterHSet = generateSegmentPrefix(prefix+"hset:counter:dst", tr)
 	return k
 }
 
+// TenantsSetName is the redis key name of the set that holds the tenants that
+// have counters.
+const TenantsSetName = "set:tenants"
+
+const tenantKeyPrefix = "tenant"
+
+// tenantPrefix returns the key name prefix of the given tenant.
+func tenantPrefix(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return tenantKeyPrefix + seperator + tenant + seperator
+}
+
+// ValidateTenant checks if the given tenant id can be used in the key names
+// and the collection names. Empty tenant is the default tenant.
+func ValidateTenant(tenant string) error {
+	if len(tenant) > 64 {
+		return errors.New("tenant should be at most 64 chars")
+	}
+
+	for _, r := range tenant {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '_' || r == '-') {
+			return fmt.Errorf("tenant has an invalid char: %q", r)
+		}
+	}
+
+	return nil
+}
+
+// StoppedTokenKey generates the redis key name that marks the token with the
+// given id as stopped.
+func StoppedTokenKey(tokenID string) string {
+	return "str:token:stopped" + seperator + tokenID
+}
+
 // HashSetName combines the prefix and the srcMember
 func (k *KeyNames) HashSetName(srcMember string) string {
 	return k.CurrentCounterHSet + seperator + srcMember
@@ -61,6 +174,7 @@ func generateSegmentPrefix(directionSuffix string, tr time.Time) string {
 
 // ParsedKeyName holds the parts of a key as separate entities
 type ParsedKeyName struct {
+	Tenant     string
 	Type       string
 	WorkerName string
 	Direction  string
@@ -71,11 +185,18 @@ type ParsedKeyName struct {
 // ParseKeyName parses the given key.
 func ParseKeyName(s string) *ParsedKeyName {
 	parts := strings.Split(s, seperator)
+
+	var tenant string
+	if len(parts) > 2 && parts[0] == tenantKeyPrefix {
+		tenant, parts = parts[1], parts[2:]
+	}
+
 	if len(parts) != 4 && len(parts) != 5 {
 		panic("key names should be consisted of either 4 or 5 parts")
 	}
 
 	pk := &ParsedKeyName{
+		Tenant:     tenant,
 		Type:       parts[0],
 		WorkerName: parts[1],
 		Direction:  parts[2],
@@ -87,3 +208,105 @@ func ParseKeyName(s string) *ParsedKeyName {
 
 	return pk
 }
+
+// FieldName generates the hash field name for the given function and metric.
+func FieldName(funcName, metric string) string {
+	if metric == MetricDuration {
+		return funcName
+	}
+	return funcName + fieldSeperator + metric
+}
+
+// ParseFieldName splits the given hash field into its function and metric
+// names. Fields without a known metric suffix hold the total duration.
+func ParseFieldName(field string) (funcName, metric string) {
+	i := strings.LastIndex(field, fieldSeperator)
+	if i == -1 {
+		return field, MetricDuration
+	}
+
+	switch m := field[i+1:]; {
+	case m == MetricCalls, m == MetricMin, m == MetricMax:
+		return field[:i], m
+	case strings.HasPrefix(m, MetricBucketPrefix),
+		strings.HasPrefix(m, MetricOutcomePrefix),
+		strings.HasPrefix(m, MetricErrorClassPrefix):
+		return field[:i], m
+	default:
+		return field, MetricDuration
+	}
+}
+
+// BucketMetric returns the metric name of the first bucket that the given
+// duration fits in. Buckets should be sorted in ascending order, durations
+// longer than the last bucket are counted in the "inf" bucket.
+func BucketMetric(buckets []time.Duration, dur time.Duration) string {
+	for _, le := range buckets {
+		if dur <= le {
+			return MetricBucketPrefix + strconv.FormatInt(int64(le), 10)
+		}
+	}
+	return MetricBucketPrefix + bucketInf
+}
+
+// ParseLatencyBuckets parses the comma separated bucket upper bounds, eg:
+// "1ms,10ms,100ms,1s".
+func ParseLatencyBuckets(s string) ([]time.Duration, error) {
+	var buckets []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		le, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+
+		if le <= 0 {
+			return nil, fmt.Errorf("bucket should be positive: %s", le)
+		}
+
+		if len(buckets) > 0 && le <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets should be in ascending order: %s", s)
+		}
+
+		buckets = append(buckets, le)
+	}
+
+	return buckets, nil
+}
+
+// ValidateOutcome checks if the given outcome and the error class can be
+// recorded. Error class is only allowed for the failed calls.
+func ValidateOutcome(outcome, errorClass string) error {
+	switch outcome {
+	case OutcomeSuccess, OutcomeCancelled, OutcomeTimeout:
+		if errorClass != "" {
+			return fmt.Errorf("error class is not allowed for %q outcome", outcome)
+		}
+	case OutcomeError:
+	default:
+		return fmt.Errorf("invalid outcome: %q", outcome)
+	}
+
+	if len(errorClass) > maxErrorClassLen {
+		return fmt.Errorf("error class should be at most %d chars", maxErrorClassLen)
+	}
+
+	if strings.Contains(errorClass, fieldSeperator) {
+		return fmt.Errorf("error class can not contain %q", fieldSeperator)
+	}
+
+	return nil
+}
+
+// ValidateFuncName checks if the given function name can be used in the
+// counter hash fields and the series names.
+func ValidateFuncName(funcName string) error {
+	if funcName == "" {
+		return errors.New("function name should be set")
+	}
+
+	if i := strings.IndexAny(funcName, fieldSeperator+"{}"); i != -1 {
+		return fmt.Errorf("function name can not contain %q", funcName[i])
+	}
+
+	return nil
+}
@@ -8,7 +8,8 @@ import (
 
 func TestGenerateKeyNames(t *testing.T) {
 	type args struct {
-		tr time.Time
+		tenant string
+		tr     time.Time
 	}
 	tests := []struct {
 		name string
@@ -31,12 +32,286 @@ func TestGenerateKeyNames(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "tenant test",
+			args: args{
+				tenant: "acme",
+				tr:     time.Date(2017, time.March, 7, 06, 30, 0, 0, time.UTC),
+			},
+			want: &AllKeys{
+				Src: KeyNames{
+					CurrentCounterSet:  "tenant:acme:set:counter:src:1488868200",
+					CurrentCounterHSet: "tenant:acme:hset:counter:src:1488868200",
+				},
+				Dst: KeyNames{
+					CurrentCounterSet:  "tenant:acme:set:counter:dst:1488868200",
+					CurrentCounterHSet: "tenant:acme:hset:counter:dst:1488868200",
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := GenerateKeyNames(tt.args.tr); !reflect.DeepEqual(got, tt.want) {
+			if got := GenerateKeyNames(tt.args.tenant, tt.args.tr); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("GenerateKeyNames() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestParseKeyName(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want *ParsedKeyName
+	}{
+		{
+			name: "default tenant",
+			s:    "hset:counter:src:1488868200:cihangir",
+			want: &ParsedKeyName{Type: "hset", WorkerName: "counter", Direction: "src", Segment: "1488868200", Name: "cihangir"},
+		},
+		{
+			name: "tenant",
+			s:    "tenant:acme:hset:counter:dst:1488868200:cihangir",
+			want: &ParsedKeyName{Tenant: "acme", Type: "hset", WorkerName: "counter", Direction: "dst", Segment: "1488868200", Name: "cihangir"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseKeyName(tt.s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseKeyName() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSegment(t *testing.T) {
+	segment := time.Date(2017, time.March, 7, 06, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		t    time.Time
+		want time.Time
+	}{
+		{
+			name: "start of the segment",
+			t:    segment,
+			want: segment,
+		},
+		{
+			name: "end of the segment",
+			t:    segment.Add(SegmentDur - time.Nanosecond),
+			want: segment,
+		},
+		{
+			name: "next segment",
+			t:    segment.Add(SegmentDur),
+			want: segment.Add(SegmentDur),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetSegment(tt.t); !got.Equal(tt.want) {
+				t.Errorf("GetSegment() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFieldName(t *testing.T) {
+	tests := []struct {
+		name         string
+		field        string
+		wantFuncName string
+		wantMetric   string
+	}{
+		{
+			name:         "bare function name holds the duration",
+			field:        "fn1",
+			wantFuncName: "fn1",
+			wantMetric:   MetricDuration,
+		},
+		{
+			name:         "calls metric",
+			field:        FieldName("fn1", MetricCalls),
+			wantFuncName: "fn1",
+			wantMetric:   MetricCalls,
+		},
+		{
+			name:         "max metric",
+			field:        FieldName("fn1", MetricMax),
+			wantFuncName: "fn1",
+			wantMetric:   MetricMax,
+		},
+		{
+			name:         "unknown metric is a part of the function name",
+			field:        "fn1|unknown",
+			wantFuncName: "fn1|unknown",
+			wantMetric:   MetricDuration,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			funcName, metric := ParseFieldName(tt.field)
+			if funcName != tt.wantFuncName {
+				t.Errorf("ParseFieldName() funcName = %v, want %v", funcName, tt.wantFuncName)
+			}
+			if metric != tt.wantMetric {
+				t.Errorf("ParseFieldName() metric = %v, want %v", metric, tt.wantMetric)
+			}
+		})
+	}
+}
+
+func TestBucketMetric(t *testing.T) {
+	buckets := []time.Duration{time.Millisecond, time.Second}
+	tests := []struct {
+		name string
+		dur  time.Duration
+		want string
+	}{
+		{
+			name: "lower than the first bucket",
+			dur:  time.Microsecond,
+			want: "le_1000000",
+		},
+		{
+			name: "equal to the bucket bound",
+			dur:  time.Second,
+			want: "le_1000000000",
+		},
+		{
+			name: "longer than the last bucket",
+			dur:  time.Minute,
+			want: "le_inf",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BucketMetric(buckets, tt.dur); got != tt.want {
+				t.Errorf("BucketMetric() = %v, want %v", got, tt.want)
+			}
+			if _, metric := ParseFieldName(FieldName("fn", tt.want)); metric != tt.want {
+				t.Errorf("ParseFieldName() metric = %v, want %v", metric, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLatencyBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []time.Duration
+		wantErr bool
+	}{
+		{
+			name: "sorted buckets",
+			s:    "1ms, 10ms,1s",
+			want: []time.Duration{time.Millisecond, 10 * time.Millisecond, time.Second},
+		},
+		{
+			name:    "unsorted buckets",
+			s:       "10ms,1ms",
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			s:       "10ms,fast",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLatencyBuckets(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseLatencyBuckets() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseLatencyBuckets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateOutcome(t *testing.T) {
+	tests := []struct {
+		name       string
+		outcome    string
+		errorClass string
+		wantErr    bool
+	}{
+		{
+			name:    "success",
+			outcome: OutcomeSuccess,
+		},
+		{
+			name:       "error with class",
+			outcome:    OutcomeError,
+			errorClass: "timeout",
+		},
+		{
+			name:       "success with error class",
+			outcome:    OutcomeSuccess,
+			errorClass: "timeout",
+			wantErr:    true,
+		},
+		{
+			name:       "error class with field seperator",
+			outcome:    OutcomeError,
+			errorClass: "a|b",
+			wantErr:    true,
+		},
+		{
+			name:    "unknown outcome",
+			outcome: "failed",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateOutcome(tt.outcome, tt.errorClass); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateOutcome() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateFuncName(t *testing.T) {
+	tests := []struct {
+		name     string
+		funcName string
+		wantErr  bool
+	}{
+		{
+			name:     "plain",
+			funcName: "users.get",
+		},
+		{
+			name:    "empty",
+			wantErr: true,
+		},
+		{
+			name:     "with field seperator",
+			funcName: "users|get",
+			wantErr:  true,
+		},
+		{
+			name:     "with labels",
+			funcName: "users.get{region=eu}",
+			wantErr:  true,
+		},
+		{
+			name:     "with closing brace",
+			funcName: "users}",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateFuncName(tt.funcName); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateFuncName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// JWK is a public JSON Web Key, see RFC 7517.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+
+	// RSA public key parameters
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// ECDSA public key parameters
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public part of the signing key. Symmetric keys can not be
+// published, so returns false for them.
+func (k *SigningKey) JWK() (JWK, bool) {
+	jwk := JWK{
+		Use: "sig",
+		Alg: k.Method.Alg(),
+		Kid: k.ID,
+	}
+
+	switch pub := k.PublicKey().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeJWKInt(pub.N, 0)
+		jwk.E = encodeJWKInt(big.NewInt(int64(pub.E)), 0)
+	case *ecdsa.PublicKey:
+		params := pub.Curve.Params()
+		size := (params.BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = params.Name
+		jwk.X = encodeJWKInt(pub.X, size)
+		jwk.Y = encodeJWKInt(pub.Y, size)
+	default:
+		return JWK{}, false
+	}
+
+	return jwk, true
+}
+
+// encodeJWKInt encodes the given integer as base64url, left padding it with
+// zeros up to size bytes.
+func encodeJWKInt(i *big.Int, size int) string {
+	b := i.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
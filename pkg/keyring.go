@@ -0,0 +1,219 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// activeKeyFile holds the id of the active signing key in a key ring
+// directory.
+const activeKeyFile = "active"
+
+var defaultTenants = NewTenants(NewKeyRing(DefaultSigningKey))
+
+// ErrUnknownTenant is returned when there are no keys for a tenant.
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// VerificationKeys looks up the key that verifies a token by the token's
+// tenant and kid header.
+type VerificationKeys interface {
+	VerificationKey(tenant, kid string) (*SigningKey, error)
+}
+
+// VerificationKey implements VerificationKeys for a single key of the default
+// tenant.
+func (k *SigningKey) VerificationKey(tenant, kid string) (*SigningKey, error) {
+	if tenant != "" {
+		return nil, ErrUnknownTenant
+	}
+	if kid != k.ID {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+	return k, nil
+}
+
+// KeyRing holds the signing keys by their ids. One of them is active and is
+// used for signing, all of them are used for verifying the tokens. Keeping the
+// previous keys in the ring lets the tokens that are signed before a rotation
+// to be stopped after it.
+//
+// Keys that are removed from the key ring directory are retired, they are
+// only used for verifying for the retention of the ring, so the tokens that
+// are signed with them can still be stopped till they expire.
+type KeyRing struct {
+	dir       string
+	retention time.Duration
+
+	mu      sync.RWMutex
+	keys    map[string]*SigningKey
+	retired map[string]retiredKey
+	active  *SigningKey
+}
+
+// retiredKey is a key that is removed from the key ring directory.
+type retiredKey struct {
+	key       *SigningKey
+	retiredAt time.Time
+}
+
+// NewKeyRing creates a key ring with the given keys, first one is the active
+// key.
+func NewKeyRing(active *SigningKey, keys ...*SigningKey) *KeyRing {
+	r := &KeyRing{
+		keys:   map[string]*SigningKey{active.ID: active},
+		active: active,
+	}
+	for _, key := range keys {
+		r.keys[key.ID] = key
+	}
+	return r
+}
+
+// LoadKeyRing loads the keys from the given directory. Every "<kid>.pem" file
+// is a PEM encoded private key, every "<kid>.secret" file is a HMAC secret and
+// the "active" file holds the kid of the key that is used for signing. Removed
+// keys are kept for verifying for the given retention, it should be at least
+// the token TTL.
+func LoadKeyRing(dir string, retention time.Duration) (*KeyRing, error) {
+	r := &KeyRing{
+		dir:       dir,
+		retention: retention,
+		retired:   make(map[string]retiredKey),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the keys from the key ring directory. Current keys are kept
+// as is if any of the keys can not be loaded.
+func (r *KeyRing) Reload() error {
+	return r.reload(time.Now())
+}
+
+func (r *KeyRing) reload(now time.Time) error {
+	if r.dir == "" {
+		return errors.New("key ring is not loaded from a directory")
+	}
+
+	paths, err := filepath.Glob(filepath.Join(r.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*SigningKey, len(paths))
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		if keys[kid], err = LoadSigningKey(kid, path); err != nil {
+			return err
+		}
+	}
+
+	if paths, err = filepath.Glob(filepath.Join(r.dir, "*.secret")); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		secret, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if secret = bytes.TrimSpace(secret); len(secret) == 0 {
+			return fmt.Errorf("%s is empty", path)
+		}
+
+		key := NewHMACKey(secret)
+		key.ID = strings.TrimSuffix(filepath.Base(path), ".secret")
+		keys[key.ID] = key
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, activeKeyFile))
+	if err != nil {
+		return err
+	}
+
+	activeID := strings.TrimSpace(string(data))
+	active, ok := keys[activeID]
+	if !ok {
+		return fmt.Errorf("active key %q is not in %s", activeID, r.dir)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for kid, key := range r.keys {
+		if _, ok := keys[kid]; !ok {
+			r.retired[kid] = retiredKey{key: key, retiredAt: now}
+		}
+	}
+
+	for kid, retired := range r.retired {
+		if _, ok := keys[kid]; ok || now.Sub(retired.retiredAt) > r.retention {
+			delete(r.retired, kid)
+		}
+	}
+
+	r.keys, r.active = keys, active
+	return nil
+}
+
+// Active returns the key that is used for signing.
+func (r *KeyRing) Active() *SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.active
+}
+
+// VerificationKey implements VerificationKeys for the keys of the default
+// tenant.
+func (r *KeyRing) VerificationKey(tenant, kid string) (*SigningKey, error) {
+	if tenant != "" {
+		return nil, ErrUnknownTenant
+	}
+	return r.lookup(kid)
+}
+
+func (r *KeyRing) lookup(kid string) (*SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if key, ok := r.keys[kid]; ok {
+		return key, nil
+	}
+
+	if retired, ok := r.retired[kid]; ok {
+		return retired.key, nil
+	}
+
+	return nil, fmt.Errorf("unknown key id: %q", kid)
+}
+
+// JWKS returns the public keys in the ring, including the retired ones.
+func (r *KeyRing) JWKS() *JWKS {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	jwks := &JWKS{Keys: []JWK{}}
+	add := func(key *SigningKey) {
+		if jwk, ok := key.JWK(); ok {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+
+	for _, key := range r.keys {
+		add(key)
+	}
+
+	for _, retired := range r.retired {
+		add(retired.key)
+	}
+	return jwks
+}
@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestKeyRing_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeECKey(t, dir, "key1")
+	writeActiveKey(t, dir, "key1")
+
+	ring, err := LoadKeyRing(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadKeyRing() error = %v", err)
+	}
+
+	oldToken, err := SignJWT(ring.Active(), &JWTData{Source: "src", Target: "tgt", FuncName: "fn"})
+	if err != nil {
+		t.Fatalf("SignJWT() error = %v", err)
+	}
+
+	// rotate the keys
+	writeECKey(t, dir, "key2")
+	writeActiveKey(t, dir, "key2")
+	if err := ring.Reload(); err != nil {
+		t.Fatalf("KeyRing.Reload() error = %v", err)
+	}
+
+	if id := ring.Active().ID; id != "key2" {
+		t.Errorf("KeyRing.Active().ID = %v, want key2", id)
+	}
+
+	if _, err := ParseJWT(log.NewNopLogger(), ring, oldToken); err != nil {
+		t.Errorf("ParseJWT() should verify the tokens signed before the rotation, error = %v", err)
+	}
+
+	if n := len(ring.JWKS().Keys); n != 2 {
+		t.Errorf("len(KeyRing.JWKS().Keys) = %d, want 2", n)
+	}
+
+	// unknown active key should not break the current ring
+	writeActiveKey(t, dir, "key3")
+	if err := ring.Reload(); err == nil {
+		t.Errorf("KeyRing.Reload() should fail for an unknown active key")
+	}
+
+	if id := ring.Active().ID; id != "key2" {
+		t.Errorf("KeyRing.Active().ID = %v, want key2", id)
+	}
+}
+
+func TestKeyRing_retired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeECKey(t, dir, "key1")
+	writeActiveKey(t, dir, "key1")
+
+	ring, err := LoadKeyRing(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadKeyRing() error = %v", err)
+	}
+
+	oldToken, err := SignJWT(ring.Active(), &JWTData{Source: "src", Target: "tgt", FuncName: "fn"})
+	if err != nil {
+		t.Fatalf("SignJWT() error = %v", err)
+	}
+
+	// rotate the keys and remove the old one
+	writeECKey(t, dir, "key2")
+	writeActiveKey(t, dir, "key2")
+	if err := os.Remove(filepath.Join(dir, "key1.pem")); err != nil {
+		t.Fatalf("os.Remove() error = %v", err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name     string
+		at       time.Time
+		wantErr  bool
+		wantKeys int
+	}{
+		{
+			name:     "retired",
+			at:       now,
+			wantKeys: 2,
+		},
+		{
+			name:     "within the retention",
+			at:       now.Add(time.Hour),
+			wantKeys: 2,
+		},
+		{
+			name:     "after the retention",
+			at:       now.Add(time.Hour + time.Second),
+			wantErr:  true,
+			wantKeys: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ring.reload(tt.at); err != nil {
+				t.Fatalf("KeyRing.reload() error = %v", err)
+			}
+
+			if id := ring.Active().ID; id != "key2" {
+				t.Errorf("KeyRing.Active().ID = %v, want key2", id)
+			}
+
+			if _, err := ParseJWT(log.NewNopLogger(), ring, oldToken); (err != nil) != tt.wantErr {
+				t.Errorf("ParseJWT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if n := len(ring.JWKS().Keys); n != tt.wantKeys {
+				t.Errorf("len(KeyRing.JWKS().Keys) = %d, want %d", n, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func writeECKey(t *testing.T, dir, kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() error = %v", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey() error = %v", err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, kid+".pem"), data, 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile() error = %v", err)
+	}
+}
+
+func writeActiveKey(t *testing.T, dir, kid string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, activeKeyFile), []byte(kid+"\n"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile() error = %v", err)
+	}
+}
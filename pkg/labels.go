@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// OtherLabelValue replaces the label values that are seen after the
+	// per segment value cap is reached.
+	OtherLabelValue = "_other"
+
+	maxLabelValueLen = 64
+)
+
+// LabelConfig holds the settings of the call labels.
+type LabelConfig struct {
+	// AllowedKeys holds the label keys that can be used. Labels are disabled
+	// when it is empty.
+	AllowedKeys []string
+
+	// MaxValuesPerSegment limits the distinct values of a label key in a
+	// segment. Rest of the values are recorded as OtherLabelValue.
+	MaxValuesPerSegment int
+}
+
+// DefaultLabelConfig is used when the labels are not configured. It does not
+// allow any labels.
+var DefaultLabelConfig = LabelConfig{
+	MaxValuesPerSegment: 100,
+}
+
+// Validate checks if the given labels can be recorded.
+func (l LabelConfig) Validate(labels map[string]string) error {
+	for key, val := range labels {
+		if !l.isAllowed(key) {
+			return fmt.Errorf("label %q is not allowed", key)
+		}
+
+		if val == "" || len(val) > maxLabelValueLen {
+			return fmt.Errorf("label %q should have a value of 1 to %d chars", key, maxLabelValueLen)
+		}
+
+		for _, r := range val {
+			if !isLabelRune(r) {
+				return fmt.Errorf("label %q has an invalid char: %q", key, r)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l LabelConfig) isAllowed(key string) bool {
+	for _, allowed := range l.AllowedKeys {
+		if key == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// isLabelRune reports if the rune can be used in a label value. Series names
+// rely on the label values not having any of "{},=|".
+func isLabelRune(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return true
+	case r == '_', r == '-', r == '.':
+		return true
+	default:
+		return false
+	}
+}
+
+// SeriesName combines the function name and the labels into a single
+// aggregation key, eg: "fn{plan=pro,region=eu}". Labels are sorted by their
+// keys. Returns the function name if there are no labels.
+func SeriesName(funcName string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return funcName
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + labels[key]
+	}
+
+	return funcName + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// ParseSeriesName splits the series name into its function name and labels.
+func ParseSeriesName(series string) (funcName string, labels map[string]string) {
+	i := strings.LastIndex(series, "{")
+	if i == -1 || !strings.HasSuffix(series, "}") {
+		return series, nil
+	}
+
+	labels = make(map[string]string)
+	for _, pair := range strings.Split(series[i+1:len(series)-1], ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return series, nil
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	return series[:i], labels
+}
+
+// LabelValuesSetName generates the redis key name of the set that holds the
+// values of a label key in a tenant's segment.
+func LabelValuesSetName(tenant string, segment time.Time, key string) string {
+	return tenantPrefix(tenant) + "set:labels" + seperator + strconv.FormatInt(segment.Unix(), 10) + seperator + key
+}
+
+// ErrorClassesSetName generates the redis key name of the set that holds the
+// error classes of a function in a tenant's segment.
+func ErrorClassesSetName(tenant string, segment time.Time, funcName string) string {
+	return tenantPrefix(tenant) + "set:errclasses" + seperator + strconv.FormatInt(segment.Unix(), 10) + seperator + funcName
+}
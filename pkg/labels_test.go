@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeriesName(t *testing.T) {
+	tests := []struct {
+		name     string
+		funcName string
+		labels   map[string]string
+		want     string
+	}{
+		{
+			name:     "without labels",
+			funcName: "fn",
+			want:     "fn",
+		},
+		{
+			name:     "labels are sorted",
+			funcName: "fn",
+			labels:   map[string]string{"region": "eu", "plan": "pro"},
+			want:     "fn{plan=pro,region=eu}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SeriesName(tt.funcName, tt.labels)
+			if got != tt.want {
+				t.Errorf("SeriesName() = %v, want %v", got, tt.want)
+			}
+
+			funcName, labels := ParseSeriesName(got)
+			if funcName != tt.funcName {
+				t.Errorf("ParseSeriesName() funcName = %v, want %v", funcName, tt.funcName)
+			}
+			if len(tt.labels) != 0 && !reflect.DeepEqual(labels, tt.labels) {
+				t.Errorf("ParseSeriesName() labels = %v, want %v", labels, tt.labels)
+			}
+		})
+	}
+}
+
+func TestLabelConfig_Validate(t *testing.T) {
+	config := LabelConfig{AllowedKeys: []string{"region", "version"}}
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{
+			name:   "allowed labels",
+			labels: map[string]string{"region": "eu-west", "version": "1.2.0"},
+		},
+		{
+			name:    "not allowed key",
+			labels:  map[string]string{"plan": "pro"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			labels:  map[string]string{"region": "eu,west"},
+			wantErr: true,
+		},
+		{
+			name:    "empty value",
+			labels:  map[string]string{"region": ""},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := config.Validate(tt.labels); (err != nil) != tt.wantErr {
+				t.Errorf("LabelConfig.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
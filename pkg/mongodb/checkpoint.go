@@ -0,0 +1,66 @@
+package mongodb
+
+import (
+	"errors"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const checkpointCollection = "compactor_checkpoints"
+
+// Checkpoint holds the newest segment that is fully processed by the compactor
+// in a direction.
+type Checkpoint struct {
+	Direction string    `bson:"_id" json:"direction"`
+	Segment   time.Time `bson:"segment" json:"segment"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updatedAt"`
+
+	// Fencing holds the fencing token of the compactor leader that has updated
+	// the checkpoint.
+	Fencing int64 `bson:"fencing" json:"fencing"`
+}
+
+// ErrStaleFencingToken is returned when the checkpoint is updated with a newer
+// fencing token.
+var ErrStaleFencingToken = errors.New("checkpoint is updated by a newer leader")
+
+// GetCheckpoint returns the checkpoint of the given direction. Returns
+// mgo.ErrNotFound if there is no checkpoint yet.
+func GetCheckpoint(db *MongoDB, direction string) (*Checkpoint, error) {
+	res := &Checkpoint{}
+	err := db.Run(checkpointCollection, func(c *mgo.Collection) error {
+		return c.FindId(direction).One(res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SetCheckpoint moves the checkpoint of the given direction to the given
+// segment. Checkpoint never moves backwards, and it is not updated with an
+// older fencing token than the last one.
+func SetCheckpoint(db *MongoDB, direction string, segment time.Time, fencing int64) error {
+	query := bson.M{
+		"_id": direction,
+		"$or": []bson.M{
+			{"fencing": bson.M{"$lte": fencing}},
+			{"fencing": bson.M{"$exists": false}},
+		},
+	}
+	update := bson.M{
+		"$max": bson.M{"segment": segment.UTC()},
+		"$set": bson.M{"updated_at": time.Now().UTC(), "fencing": fencing},
+	}
+	return db.Run(checkpointCollection, func(c *mgo.Collection) error {
+		// when the query does not match, the upsert fails to insert a second
+		// document with the same id.
+		_, err := c.Upsert(query, update)
+		if mgo.IsDup(err) {
+			return ErrStaleFencingToken
+		}
+		return err
+	})
+}
@@ -2,6 +2,9 @@ package mongodb
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -9,49 +12,578 @@ import (
 
 // Compaction holds the parts of a key as separate entities
 type Compaction struct {
-	ID        bson.ObjectId    `bson:"_id,omitempty" json:"_id"`
-	Direction string           `bson:"direction" json:"direction"`
-	Segment   string           `bson:"segment" json:"segment"`
-	UserID    string           `bson:"user_id" json:"user_id"`
-	Data      map[string]int64 `bson:"data" json:"data"`
+	ID        bson.ObjectId         `bson:"_id,omitempty" json:"_id"`
+	Direction string                `bson:"direction" json:"direction"`
+	Segment   string                `bson:"segment" json:"segment"`
+	UserID    string                `bson:"user_id" json:"user_id"`
+	Data      map[string]*FuncStats `bson:"data" json:"data"`
+
+	// Series holds the labeled values per series, eg: "fn{region=eu}". Data
+	// holds the totals of the series per function.
+	Series map[string]*Series `bson:"series,omitempty" json:"series,omitempty"`
+
+	// Segments holds the segments that are folded into a rollup document.
+	Segments []string `bson:"segments,omitempty" json:"segments,omitempty"`
+
+	// Markers holds the idempotency markers of the merges that are applied to
+	// the document.
+	Markers []string `bson:"markers,omitempty" json:"markers,omitempty"`
+}
+
+// Series holds the accumulated values of a function for a label set.
+type Series struct {
+	Func      string            `bson:"func" json:"func"`
+	Labels    map[string]string `bson:"labels" json:"labels"`
+	FuncStats `bson:",inline"`
+}
+
+// FuncStats holds the accumulated values of a function in a segment.
+type FuncStats struct {
+	// Calls holds the invocation count.
+	Calls int64 `bson:"calls" json:"calls"`
+
+	// Duration holds the total duration of the calls in nano secs.
+	Duration int64 `bson:"duration" json:"duration"`
+
+	// Min and Max hold the shortest and the longest call durations.
+	Min int64 `bson:"min" json:"min"`
+	Max int64 `bson:"max" json:"max"`
+
+	// Buckets holds the call counts per latency bucket. Keys are the upper
+	// bounds of the buckets in nano secs or "inf".
+	Buckets map[string]int64 `bson:"buckets,omitempty" json:"buckets,omitempty"`
+
+	// Outcomes holds the call counts per outcome; success, error or cancelled.
+	Outcomes map[string]int64 `bson:"outcomes,omitempty" json:"outcomes,omitempty"`
+
+	// ErrorClasses holds the failed call counts per error class.
+	ErrorClasses map[string]int64 `bson:"error_classes,omitempty" json:"error_classes,omitempty"`
+}
+
+// funcStats has the fields of FuncStats without its methods, it is used to
+// decode the stats without calling SetBSON again.
+type funcStats FuncStats
+
+// SetBSON decodes the stats. Legacy compaction documents hold only the total
+// call duration of a function as a number, it is decoded as the Duration. Any
+// other value is rejected, so a document is never rewritten with lost values.
+func (s *FuncStats) SetBSON(raw bson.Raw) error {
+	switch raw.Kind {
+	case 0x01, 0x10, 0x12: // double, int32 and int64
+		var dur int64
+		if err := raw.Unmarshal(&dur); err != nil {
+			return fmt.Errorf("legacy function stats: %s", err)
+		}
+		*s = FuncStats{Duration: dur}
+		return nil
+	case 0x03: // document
+		// errors are wrapped, as bson drops the values with type errors.
+		if err := raw.Unmarshal((*funcStats)(s)); err != nil {
+			return fmt.Errorf("function stats: %s", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("function stats can not be decoded from bson kind 0x%02x", raw.Kind)
+	}
+}
+
+// SetBSON decodes the series. Series embeds FuncStats, so it needs its own
+// decoder not to be decoded as a FuncStats.
+func (s *Series) SetBSON(raw bson.Raw) error {
+	var v struct {
+		Func      string            `bson:"func"`
+		Labels    map[string]string `bson:"labels"`
+		funcStats `bson:",inline"`
+	}
+	if err := raw.Unmarshal(&v); err != nil {
+		return fmt.Errorf("series: %s", err)
+	}
+
+	*s = Series{Func: v.Func, Labels: v.Labels, FuncStats: FuncStats(v.funcStats)}
+	return nil
+}
+
+// Add adds the values of the given stats.
+func (s *FuncStats) Add(o *FuncStats) {
+	if o.Calls != 0 && (s.Calls == 0 || o.Min < s.Min) {
+		s.Min = o.Min
+	}
+	if o.Max > s.Max {
+		s.Max = o.Max
+	}
+
+	s.Calls += o.Calls
+	s.Duration += o.Duration
+	s.Buckets = addCounts(s.Buckets, o.Buckets)
+	s.Outcomes = addCounts(s.Outcomes, o.Outcomes)
+	s.ErrorClasses = addCounts(s.ErrorClasses, o.ErrorClasses)
 }
 
-func InsertCompaction(db *MongoDB, userID, dir, segment string, vals map[string]int64) error {
-	if len(vals) == 0 {
+func addCounts(dst, src map[string]int64) map[string]int64 {
+	if len(src) == 0 {
+		return dst
+	}
+
+	if dst == nil {
+		dst = make(map[string]int64, len(src))
+	}
+	for key, val := range src {
+		dst[key] += val
+	}
+	return dst
+}
+
+// CompactionCollection returns the compaction collection name of the given
+// tenant. Default tenant, "", uses the "compaction" collection.
+func CompactionCollection(tenant string) string {
+	if tenant == "" {
+		return "compaction"
+	}
+	return "compaction_" + tenant
+}
+
+// compactionIndex makes sure there is only one document per user, direction
+// and segment.
+var compactionIndex = mgo.Index{
+	Key:    []string{"user_id", "direction", "segment"},
+	Unique: true,
+}
+
+// segmentIndex is used by the retention sweeps.
+var segmentIndex = mgo.Index{
+	Key: []string{"segment"},
+}
+
+// keyEscaper escapes the map keys, Mongo does not allow "." and "$" in them.
+var (
+	keyEscaper   = strings.NewReplacer("%", "%25", ".", "%2E", "$", "%24")
+	keyUnescaper = strings.NewReplacer("%2E", ".", "%24", "$", "%25", "%")
+)
+
+// maxMarkers caps the markers that are kept in a compaction document, the
+// oldest ones are dropped. A member hash map is merged once per segment unless
+// it is retried or it gets late calls, so a retry is expected to find its
+// marker among the recent ones.
+const maxMarkers = 100
+
+// ErrAlreadyApplied is returned when the values with the same marker are
+// already added to the compaction document.
+var ErrAlreadyApplied = errors.New("compaction is already applied")
+
+// CompactionUpsert holds the values that are added to a compaction document.
+type CompactionUpsert struct {
+	UserID    string
+	Direction string
+	Segment   string
+	Marker    string
+	Data      map[string]*FuncStats
+	Series    map[string]*Series
+}
+
+func (u *CompactionUpsert) validate() error {
+	if len(u.Data) == 0 {
 		return errors.New("nil data")
 	}
 
-	return db.Run("compaction", func(c *mgo.Collection) error {
-		return c.Insert(&Compaction{
-			ID:        bson.NewObjectId(),
-			UserID:    userID,
-			Direction: dir,
-			Segment:   segment,
-			Data:      vals,
-		})
+	if u.Marker == "" {
+		return errors.New("marker should be set")
+	}
+
+	return nil
+}
+
+// query matches the compaction document unless it has the marker. When the
+// document has the marker, the upsert fails to insert a second document for
+// the segment.
+func (u *CompactionUpsert) query() bson.M {
+	return bson.M{
+		"user_id":   u.UserID,
+		"direction": u.Direction,
+		"segment":   u.Segment,
+		"markers":   bson.M{"$ne": u.Marker},
+	}
+}
+
+func (u *CompactionUpsert) update() bson.M {
+	update := compactionUpdate(u.Data, u.Series)
+	update["$push"] = bson.M{"markers": bson.M{
+		"$each":  []string{u.Marker},
+		"$slice": -maxMarkers,
+	}}
+	return update
+}
+
+// MigrateLegacyCompactions converts the function values of the legacy
+// compaction documents of the given collection, the total call durations, to
+// function stats, so the stats can be incremented in them. Legacy documents
+// are the ones without any markers. Returns the number of the converted
+// documents. It is meant to be run once per collection, before the compactions
+// are upserted.
+func MigrateLegacyCompactions(db *MongoDB, collection string) (int, error) {
+	var migrated int
+	err := db.Run(collection, func(c *mgo.Collection) error {
+		iter := c.Find(bson.M{"markers": bson.M{"$exists": false}}).Select(bson.M{"data": 1}).Iter()
+
+		var doc struct {
+			ID   bson.ObjectId       `bson:"_id"`
+			Data map[string]bson.Raw `bson:"data"`
+		}
+		for iter.Next(&doc) {
+			set, err := legacyStats(doc.Data)
+			if err != nil {
+				iter.Close()
+				return fmt.Errorf("compaction %s: %s", doc.ID.Hex(), err)
+			}
+
+			if len(set) == 0 {
+				continue
+			}
+
+			if err := c.UpdateId(doc.ID, bson.M{"$set": set}); err != nil {
+				iter.Close()
+				return err
+			}
+			migrated++
+		}
+		return iter.Close()
 	})
+	return migrated, err
 }
 
-func GetCompaction(db *MongoDB, userID, dir, segment string) (map[string]int64, error) {
+// legacyStats returns the $set fields that convert the legacy values of the
+// data to function stats. Min and max are left unset, as they are unknown.
+func legacyStats(data map[string]bson.Raw) (bson.M, error) {
+	set := bson.M{}
+	for funcName, raw := range data {
+		if raw.Kind == 0x03 {
+			continue
+		}
+
+		st := &FuncStats{}
+		if err := st.SetBSON(raw); err != nil {
+			return nil, fmt.Errorf("%q: %s", funcName, err)
+		}
+
+		set["data."+funcName] = bson.M{"calls": st.Calls, "duration": st.Duration}
+	}
+	return set, nil
+}
+
+// EnsureCompactionIndex builds the unique compaction index of the given
+// collection. Documents of the same user, direction and segment, that are
+// inserted before the compactions were upserted, are merged into their oldest
+// document first, as the index can not be built with them. Returns the number
+// of the removed duplicates. It is meant to be run once per collection, before
+// the compactions are upserted.
+func EnsureCompactionIndex(db *MongoDB, collection string) (int, error) {
+	var removed int
+	err := db.Run(collection, func(c *mgo.Collection) error {
+		iter := c.Pipe([]bson.M{
+			{"$group": bson.M{
+				"_id":   bson.M{"user_id": "$user_id", "direction": "$direction", "segment": "$segment"},
+				"ids":   bson.M{"$push": "$_id"},
+				"count": bson.M{"$sum": 1},
+			}},
+			{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+		}).AllowDiskUse().Iter()
+
+		var dup struct {
+			IDs []bson.ObjectId `bson:"ids"`
+		}
+		for iter.Next(&dup) {
+			n, err := mergeDuplicates(c, dup.IDs)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			removed += n
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+
+		return c.EnsureIndex(compactionIndex)
+	})
+	return removed, err
+}
+
+// mergeDuplicates adds the values of the documents with the given ids to the
+// oldest one of them and removes the rest. Nothing is written if any of the
+// documents can not be decoded, legacy values included, see FuncStats.SetBSON.
+// Returns the number of the removed documents.
+func mergeDuplicates(c *mgo.Collection, ids []bson.ObjectId) (int, error) {
+	var docs []*Compaction
+	if err := c.Find(bson.M{"_id": bson.M{"$in": ids}}).Sort("_id").All(&docs); err != nil {
+		return 0, err
+	}
+
+	if len(docs) < 2 {
+		return 0, nil
+	}
+
+	doc, dups := docs[0], make([]bson.ObjectId, 0, len(docs)-1)
+	for _, dup := range docs[1:] {
+		doc.merge(dup)
+		dups = append(dups, dup.ID)
+	}
+
+	// a crash in between leaves the duplicates behind, they are merged
+	// again in the next run, so the merged document is updated first.
+	if err := c.UpdateId(doc.ID, doc); err != nil {
+		return 0, err
+	}
+
+	info, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": dups}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// merge adds the values and the markers of the given document of the same
+// user, direction and segment. Map keys are already escaped in the stored
+// documents, so they are used as is.
+func (doc *Compaction) merge(dup *Compaction) {
+	if doc.Data == nil {
+		doc.Data = make(map[string]*FuncStats)
+	}
+	for funcName, st := range dup.Data {
+		if _, ok := doc.Data[funcName]; !ok {
+			doc.Data[funcName] = &FuncStats{}
+		}
+		doc.Data[funcName].Add(st)
+	}
+
+	for seriesName, sr := range dup.Series {
+		if doc.Series == nil {
+			doc.Series = make(map[string]*Series)
+		}
+		if _, ok := doc.Series[seriesName]; !ok {
+			doc.Series[seriesName] = &Series{Func: sr.Func, Labels: sr.Labels}
+		}
+		doc.Series[seriesName].Add(&sr.FuncStats)
+	}
+
+	doc.Markers = append(doc.Markers, dup.Markers...)
+	if len(doc.Markers) > maxMarkers {
+		doc.Markers = doc.Markers[len(doc.Markers)-maxMarkers:]
+	}
+}
+
+// UpsertCompaction adds the given values to the compaction document of the
+// user, direction and segment. Document is created if it does not exist yet,
+// so merging the same segment more than once adds up the values. The marker is
+// recorded with the values in the same write, values with an already recorded
+// marker are not added again and ErrAlreadyApplied is returned.
+func UpsertCompaction(db *MongoDB, tenant, userID, dir, segment, marker string, vals map[string]*FuncStats, series map[string]*Series) error {
+	u := &CompactionUpsert{
+		UserID:    userID,
+		Direction: dir,
+		Segment:   segment,
+		Marker:    marker,
+		Data:      vals,
+		Series:    series,
+	}
+
+	if err := u.validate(); err != nil {
+		return err
+	}
+
+	return db.Run(CompactionCollection(tenant), func(c *mgo.Collection) error {
+		return upsertCompaction(c, u)
+	})
+}
+
+func upsertCompaction(c *mgo.Collection, u *CompactionUpsert) error {
+	_, err := c.Upsert(u.query(), u.update())
+	if !mgo.IsDup(err) {
+		return err
+	}
+
+	// a concurrent upsert might have created the document, try again.
+	_, err = c.Upsert(u.query(), u.update())
+	if mgo.IsDup(err) {
+		return ErrAlreadyApplied
+	}
+	return err
+}
+
+// BulkUpsertCompactions adds the values of the given upserts to the compaction
+// documents of the tenant with a single bulk write. Returns the errors of the
+// upserts in the same order, see UpsertCompaction for the details.
+func BulkUpsertCompactions(db *MongoDB, tenant string, upserts []*CompactionUpsert) ([]error, error) {
+	errs := make([]error, len(upserts))
+
+	// indexes of the upserts in the bulk
+	var idxs []int
+	for i, u := range upserts {
+		if errs[i] = u.validate(); errs[i] == nil {
+			idxs = append(idxs, i)
+		}
+	}
+
+	if len(idxs) == 0 {
+		return errs, nil
+	}
+
+	err := db.Run(CompactionCollection(tenant), func(c *mgo.Collection) error {
+		bulk := c.Bulk()
+		bulk.Unordered()
+		for _, i := range idxs {
+			bulk.Upsert(upserts[i].query(), upserts[i].update())
+		}
+
+		_, err := bulk.Run()
+		berr, ok := err.(*mgo.BulkError)
+		if !ok {
+			return err
+		}
+
+		for _, ecase := range berr.Cases() {
+			if ecase.Index < 0 || ecase.Index >= len(idxs) {
+				return err
+			}
+
+			i := idxs[ecase.Index]
+			if errs[i] = ecase.Err; mgo.IsDup(ecase.Err) {
+				// tell a concurrent insert from an applied marker.
+				errs[i] = upsertCompaction(c, upserts[i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return errs, nil
+}
+
+// compactionUpdate creates the update document that adds the given values to
+// a compaction document.
+func compactionUpdate(vals map[string]*FuncStats, series map[string]*Series) bson.M {
+	inc, min, max, set := bson.M{}, bson.M{}, bson.M{}, bson.M{}
+	for funcName, st := range vals {
+		st.update("data."+escapeKey(funcName), inc, min, max)
+	}
+
+	for seriesName, sr := range series {
+		path := "series." + escapeKey(seriesName)
+		set[path+".func"] = sr.Func
+		set[path+".labels"] = sr.Labels
+		sr.FuncStats.update(path, inc, min, max)
+	}
+
+	update := bson.M{"$inc": inc}
+	for op, fields := range map[string]bson.M{"$min": min, "$max": max, "$set": set} {
+		if len(fields) != 0 {
+			update[op] = fields
+		}
+	}
+	return update
+}
+
+// update adds the update operations of the stats under the given path.
+func (s *FuncStats) update(path string, inc, min, max bson.M) {
+	inc[path+".calls"] = s.Calls
+	inc[path+".duration"] = s.Duration
+
+	// min of a stats without any calls is meaningless.
+	if s.Calls != 0 {
+		min[path+".min"] = s.Min
+		max[path+".max"] = s.Max
+	}
+
+	for key, counts := range map[string]map[string]int64{
+		"buckets":       s.Buckets,
+		"outcomes":      s.Outcomes,
+		"error_classes": s.ErrorClasses,
+	} {
+		for name, val := range counts {
+			inc[path+"."+key+"."+escapeKey(name)] = val
+		}
+	}
+}
+
+func escapeKey(key string) string {
+	return keyEscaper.Replace(key)
+}
+
+func unescapeKey(key string) string {
+	return keyUnescaper.Replace(key)
+}
+
+func unescapeCounts(counts map[string]int64) map[string]int64 {
+	if counts == nil {
+		return nil
+	}
+
+	res := make(map[string]int64, len(counts))
+	for key, val := range counts {
+		res[unescapeKey(key)] = val
+	}
+	return res
+}
+
+func unescapeStats(stats map[string]*FuncStats) map[string]*FuncStats {
+	if stats == nil {
+		return nil
+	}
+
+	res := make(map[string]*FuncStats, len(stats))
+	for key, st := range stats {
+		st.Buckets = unescapeCounts(st.Buckets)
+		st.Outcomes = unescapeCounts(st.Outcomes)
+		st.ErrorClasses = unescapeCounts(st.ErrorClasses)
+		res[unescapeKey(key)] = st
+	}
+	return res
+}
+
+func GetCompaction(db *MongoDB, tenant, userID, dir, segment string) (map[string]*FuncStats, error) {
 	query := bson.M{
 		"user_id":   userID,
 		"direction": dir,
 		"segment":   segment,
 	}
 	res := &Compaction{}
-	return res.Data, db.Run("compaction", func(c *mgo.Collection) error {
-		err := c.Find(query).One(res)
-		return err
+	err := db.Run(CompactionCollection(tenant), func(c *mgo.Collection) error {
+		return c.Find(query).One(res)
 	})
+	return unescapeStats(res.Data), err
 }
 
-func DeleteCompaction(db *MongoDB, userID, dir, segment string) error {
+func DeleteCompaction(db *MongoDB, tenant, userID, dir, segment string) error {
 	query := bson.M{
 		"user_id":   userID,
 		"direction": dir,
 		"segment":   segment,
 	}
-	return db.Run("compaction", func(c *mgo.Collection) error {
+	return db.Run(CompactionCollection(tenant), func(c *mgo.Collection) error {
 		return c.Remove(query)
 	})
 }
+
+// ExpireCompactions deletes the documents of the given collection with the
+// segments before the given time and returns the number of deleted documents.
+func ExpireCompactions(db *MongoDB, collection string, before time.Time) (int, error) {
+	query := bson.M{
+		"segment": bson.M{"$lt": formatSegment(before)},
+	}
+
+	var removed int
+	err := db.Run(collection, func(c *mgo.Collection) error {
+		if err := c.EnsureIndex(segmentIndex); err != nil {
+			return err
+		}
+
+		info, err := c.RemoveAll(query)
+		if err != nil {
+			return err
+		}
+
+		removed = info.Removed
+		return nil
+	})
+	return removed, err
+}
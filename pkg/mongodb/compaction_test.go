@@ -0,0 +1,255 @@
+package mongodb
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEscapeKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "fn", want: "fn"},
+		{key: "pkg.fn", want: "pkg%2Efn"},
+		{key: "$fn", want: "%24fn"},
+		{key: "fn%2E", want: "fn%252E"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got := escapeKey(tt.key)
+			if got != tt.want {
+				t.Errorf("escapeKey() = %v, want %v", got, tt.want)
+			}
+			if key := unescapeKey(got); key != tt.key {
+				t.Errorf("unescapeKey() = %v, want %v", key, tt.key)
+			}
+		})
+	}
+}
+
+func TestCompactionUpdate(t *testing.T) {
+	vals := map[string]*FuncStats{
+		"pkg.fn": {
+			Calls:    2,
+			Duration: 10,
+			Min:      4,
+			Max:      6,
+			Outcomes: map[string]int64{"success": 2},
+		},
+		"fn2": {Duration: 3},
+	}
+	series := map[string]*Series{
+		"pkg.fn{region=eu}": {
+			Func:      "pkg.fn",
+			Labels:    map[string]string{"region": "eu"},
+			FuncStats: FuncStats{Calls: 2, Duration: 10, Min: 4, Max: 6},
+		},
+	}
+
+	want := bson.M{
+		"$inc": bson.M{
+			"data.pkg%2Efn.calls":                 int64(2),
+			"data.pkg%2Efn.duration":              int64(10),
+			"data.pkg%2Efn.outcomes.success":      int64(2),
+			"data.fn2.calls":                      int64(0),
+			"data.fn2.duration":                   int64(3),
+			"series.pkg%2Efn{region=eu}.calls":    int64(2),
+			"series.pkg%2Efn{region=eu}.duration": int64(10),
+		},
+		"$min": bson.M{
+			"data.pkg%2Efn.min":              int64(4),
+			"series.pkg%2Efn{region=eu}.min": int64(4),
+		},
+		"$max": bson.M{
+			"data.pkg%2Efn.max":              int64(6),
+			"series.pkg%2Efn{region=eu}.max": int64(6),
+		},
+		"$set": bson.M{
+			"series.pkg%2Efn{region=eu}.func":   "pkg.fn",
+			"series.pkg%2Efn{region=eu}.labels": map[string]string{"region": "eu"},
+		},
+	}
+
+	if got := compactionUpdate(vals, series); !reflect.DeepEqual(got, want) {
+		t.Errorf("compactionUpdate() = %v, want %v", got, want)
+	}
+}
+
+func TestCompactionMerge(t *testing.T) {
+	doc := &Compaction{
+		Data: map[string]*FuncStats{
+			"pkg%2Efn": {Calls: 2, Duration: 10, Min: 4, Max: 6},
+		},
+		Markers: []string{"m1"},
+	}
+	dup := &Compaction{
+		Data: map[string]*FuncStats{
+			"pkg%2Efn": {Calls: 1, Duration: 2, Min: 2, Max: 2},
+			"fn2":      {Calls: 1, Duration: 3, Min: 3, Max: 3},
+		},
+		Series: map[string]*Series{
+			"fn2{region=eu}": {
+				Func:      "fn2",
+				Labels:    map[string]string{"region": "eu"},
+				FuncStats: FuncStats{Calls: 1, Duration: 3, Min: 3, Max: 3},
+			},
+		},
+		Markers: []string{"m2"},
+	}
+
+	want := &Compaction{
+		Data: map[string]*FuncStats{
+			"pkg%2Efn": {Calls: 3, Duration: 12, Min: 2, Max: 6},
+			"fn2":      {Calls: 1, Duration: 3, Min: 3, Max: 3},
+		},
+		Series: map[string]*Series{
+			"fn2{region=eu}": {
+				Func:      "fn2",
+				Labels:    map[string]string{"region": "eu"},
+				FuncStats: FuncStats{Calls: 1, Duration: 3, Min: 3, Max: 3},
+			},
+		},
+		Markers: []string{"m1", "m2"},
+	}
+
+	if doc.merge(dup); !reflect.DeepEqual(doc, want) {
+		t.Errorf("merge() = %+v, want %+v", doc, want)
+	}
+}
+
+func TestCompactionUpsertMarkers(t *testing.T) {
+	u := &CompactionUpsert{
+		Marker: "m1",
+		Data:   map[string]*FuncStats{"fn": {Calls: 1}},
+	}
+
+	want := bson.M{"markers": bson.M{
+		"$each":  []string{"m1"},
+		"$slice": -maxMarkers,
+	}}
+	if got := u.update()["$push"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("update() $push = %v, want %v", got, want)
+	}
+}
+
+func TestCompactionDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     bson.M
+		want    *Compaction
+		wantErr bool
+	}{
+		{
+			name: "legacy durations",
+			doc: bson.M{
+				"user_id": "user1",
+				"data":    bson.M{"fn": int64(10), "fn2": 3},
+			},
+			want: &Compaction{
+				UserID: "user1",
+				Data: map[string]*FuncStats{
+					"fn":  {Duration: 10},
+					"fn2": {Duration: 3},
+				},
+			},
+		},
+		{
+			name: "function stats",
+			doc: bson.M{
+				"data": bson.M{"fn": bson.M{"calls": 2, "duration": 10, "min": 4, "max": 6}},
+				"series": bson.M{"fn{region=eu}": bson.M{
+					"func":     "fn",
+					"labels":   bson.M{"region": "eu"},
+					"calls":    2,
+					"duration": 10,
+				}},
+			},
+			want: &Compaction{
+				Data: map[string]*FuncStats{
+					"fn": {Calls: 2, Duration: 10, Min: 4, Max: 6},
+				},
+				Series: map[string]*Series{
+					"fn{region=eu}": {
+						Func:      "fn",
+						Labels:    map[string]string{"region": "eu"},
+						FuncStats: FuncStats{Calls: 2, Duration: 10},
+					},
+				},
+			},
+		},
+		{
+			name:    "unknown value",
+			doc:     bson.M{"data": bson.M{"fn": "10"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatalf("bson.Marshal() error = %v", err)
+			}
+
+			got := &Compaction{}
+			err = bson.Unmarshal(data, got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bson.Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bson.Unmarshal() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacyStats(t *testing.T) {
+	raw := func(v interface{}) bson.Raw {
+		data, err := bson.Marshal(bson.M{"v": v})
+		if err != nil {
+			t.Fatalf("bson.Marshal() error = %v", err)
+		}
+
+		var doc struct {
+			V bson.Raw `bson:"v"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			t.Fatalf("bson.Unmarshal() error = %v", err)
+		}
+		return doc.V
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]bson.Raw
+		want    bson.M
+		wantErr bool
+	}{
+		{
+			name: "legacy and migrated values",
+			data: map[string]bson.Raw{
+				"fn":  raw(int64(10)),
+				"fn2": raw(bson.M{"calls": 1, "duration": 3}),
+			},
+			want: bson.M{"data.fn": bson.M{"calls": int64(0), "duration": int64(10)}},
+		},
+		{
+			name:    "unknown value",
+			data:    map[string]bson.Raw{"fn": raw("10")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := legacyStats(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("legacyStats() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("legacyStats() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
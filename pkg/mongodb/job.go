@@ -0,0 +1,184 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const jobCollection = "compactor_jobs"
+
+// Job statuses
+const (
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job holds a compactor run that is submitted to be processed in the
+// background.
+type Job struct {
+	ID     bson.ObjectId `bson:"_id" json:"id"`
+	Status string        `bson:"status" json:"status"`
+
+	// Owner holds the compactor instance that runs the job.
+	Owner string `bson:"owner" json:"owner"`
+
+	// Request and Result hold the JSON encoded request and the latest
+	// statistics of the run.
+	Request json.RawMessage `bson:"request" json:"request"`
+	Result  json.RawMessage `bson:"result,omitempty" json:"result,omitempty"`
+	Err     string          `bson:"err,omitempty" json:"err,omitempty"`
+
+	// CancelRequested is set when the job is cancelled while it is running.
+	CancelRequested bool `bson:"cancel_requested,omitempty" json:"cancelRequested,omitempty"`
+
+	CreatedAt  time.Time `bson:"created_at" json:"createdAt"`
+	UpdatedAt  time.Time `bson:"updated_at" json:"updatedAt"`
+	FinishedAt time.Time `bson:"finished_at,omitempty" json:"finishedAt,omitempty"`
+}
+
+// ErrInvalidJobID is returned when a job id is not a valid object id.
+var ErrInvalidJobID = errors.New("invalid job id")
+
+// jobStatusIndex is used by the abandoned job sweeps.
+var jobStatusIndex = mgo.Index{
+	Key: []string{"status", "updated_at"},
+}
+
+func jobID(id string) (bson.ObjectId, error) {
+	if !bson.IsObjectIdHex(id) {
+		return "", ErrInvalidJobID
+	}
+	return bson.ObjectIdHex(id), nil
+}
+
+// InsertJob creates a running job of the given owner for the request.
+func InsertJob(db *MongoDB, owner string, req json.RawMessage) (*Job, error) {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        bson.NewObjectId(),
+		Status:    JobRunning,
+		Owner:     owner,
+		Request:   req,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err := db.Run(jobCollection, func(c *mgo.Collection) error {
+		if err := c.EnsureIndex(jobStatusIndex); err != nil {
+			return err
+		}
+		return c.Insert(job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// GetJob returns the job with the given id. Returns mgo.ErrNotFound if there is
+// no such job.
+func GetJob(db *MongoDB, id string) (*Job, error) {
+	oid, err := jobID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Job{}
+	err = db.Run(jobCollection, func(c *mgo.Collection) error {
+		return c.FindId(oid).One(res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UpdateJob records the latest result of a running job and returns the job.
+// Returns mgo.ErrNotFound if the job is not running anymore.
+func UpdateJob(db *MongoDB, id bson.ObjectId, result json.RawMessage) (*Job, error) {
+	return applyJob(db, bson.M{"_id": id, "status": JobRunning}, bson.M{
+		"$set": bson.M{"result": result, "updated_at": time.Now().UTC()},
+	})
+}
+
+// FinishJob records the final status and result of a running job.
+func FinishJob(db *MongoDB, id bson.ObjectId, status string, result json.RawMessage, errMsg string) error {
+	now := time.Now().UTC()
+	_, err := applyJob(db, bson.M{"_id": id, "status": JobRunning}, bson.M{
+		"$set": bson.M{
+			"status":      status,
+			"result":      result,
+			"err":         errMsg,
+			"updated_at":  now,
+			"finished_at": now,
+		},
+	})
+	return err
+}
+
+// CancelJob requests the cancellation of the job with the given id and returns
+// the job. Finished jobs are returned as is.
+func CancelJob(db *MongoDB, id string) (*Job, error) {
+	oid, err := jobID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := applyJob(db, bson.M{"_id": oid, "status": JobRunning}, bson.M{
+		"$set": bson.M{"cancel_requested": true},
+	})
+	if err == mgo.ErrNotFound {
+		return GetJob(db, id)
+	}
+	return job, err
+}
+
+// AbandonJobs marks the running jobs that are not updated since the given time
+// as failed, their compactor instances are gone. Returns the number of the
+// abandoned jobs.
+func AbandonJobs(db *MongoDB, before time.Time) (int, error) {
+	query := bson.M{
+		"status":     JobRunning,
+		"updated_at": bson.M{"$lt": before.UTC()},
+	}
+
+	now := time.Now().UTC()
+	update := bson.M{
+		"$set": bson.M{
+			"status":      JobFailed,
+			"err":         "job is abandoned by its compactor",
+			"updated_at":  now,
+			"finished_at": now,
+		},
+	}
+
+	var updated int
+	err := db.Run(jobCollection, func(c *mgo.Collection) error {
+		info, err := c.UpdateAll(query, update)
+		if err != nil {
+			return err
+		}
+
+		updated = info.Updated
+		return nil
+	})
+	return updated, err
+}
+
+func applyJob(db *MongoDB, query, update bson.M) (*Job, error) {
+	res := &Job{}
+	err := db.Run(jobCollection, func(c *mgo.Collection) error {
+		_, err := c.Find(query).Apply(mgo.Change{Update: update, ReturnNew: true}, res)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
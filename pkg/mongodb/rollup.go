@@ -0,0 +1,204 @@
+package mongodb
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Granularity is the window size of a rollup.
+type Granularity string
+
+// Rollup granularities
+const (
+	Hour  Granularity = "hour"
+	Day   Granularity = "day"
+	Month Granularity = "month"
+)
+
+// Granularities holds the rollup granularities, every one of them is rolled up
+// from the previous one. Hourly rollups are rolled up from the segments.
+var Granularities = []Granularity{Hour, Day, Month}
+
+// ErrUnknownGranularity is returned for the granularities that are not in
+// Granularities.
+var ErrUnknownGranularity = errors.New("unknown granularity")
+
+// Window returns the start of the window that holds the given time.
+func (g Granularity) Window(t time.Time) time.Time {
+	t = t.UTC()
+	switch g {
+	case Hour:
+		return t.Truncate(time.Hour)
+	case Day:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// Next returns the start of the window after the window of the given time.
+func (g Granularity) Next(t time.Time) time.Time {
+	switch t = g.Window(t); g {
+	case Hour:
+		return t.Add(time.Hour)
+	case Day:
+		return t.AddDate(0, 0, 1)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
+// sourceCollection returns the collection that the rollups are rolled up from.
+func (g Granularity) sourceCollection(tenant string) (string, error) {
+	switch g {
+	case Hour:
+		return CompactionCollection(tenant), nil
+	case Day:
+		return RollupCollection(tenant, Hour), nil
+	case Month:
+		return RollupCollection(tenant, Day), nil
+	default:
+		return "", ErrUnknownGranularity
+	}
+}
+
+// RollupCollection returns the rollup collection name of the given tenant and
+// granularity, eg: "compaction.hour".
+func RollupCollection(tenant string, g Granularity) string {
+	return CompactionCollection(tenant) + "." + string(g)
+}
+
+// EnsureRollupIndexes builds the unique indexes of the rollup collections of
+// the tenant. Rollup documents have always been upserted, so unlike the
+// compaction documents they do not have any duplicates to merge.
+func EnsureRollupIndexes(db *MongoDB, tenant string) error {
+	for _, g := range Granularities {
+		err := db.Run(RollupCollection(tenant, g), func(c *mgo.Collection) error {
+			return c.EnsureIndex(compactionIndex)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollup aggregates the documents of the window that holds the given time into
+// a rollup document per user and direction. Rollup documents are re-computed
+// from their sources, so the rollup of a window can be re-run after late data.
+// Only the given users are rolled up unless they are empty. Rollup documents of
+// the users without any source documents are kept as is.
+func Rollup(db *MongoDB, tenant string, g Granularity, t time.Time, userIDs []string) error {
+	src, err := g.sourceCollection(tenant)
+	if err != nil {
+		return err
+	}
+
+	// segments are unix timestamps with the same number of digits, so they can
+	// be compared as strings.
+	window := g.Window(t)
+	query := bson.M{
+		"segment": bson.M{
+			"$gte": formatSegment(window),
+			"$lt":  formatSegment(g.Next(window)),
+		},
+	}
+	if len(userIDs) != 0 {
+		query["user_id"] = bson.M{"$in": userIDs}
+	}
+
+	rollups := make(map[[2]string]*Compaction)
+	err = db.Run(src, func(c *mgo.Collection) error {
+		iter := c.Find(query).Iter()
+		for {
+			doc := &Compaction{}
+			if !iter.Next(doc) {
+				break
+			}
+
+			key := [2]string{doc.UserID, doc.Direction}
+			r, ok := rollups[key]
+			if !ok {
+				r = &Compaction{
+					UserID:    doc.UserID,
+					Direction: doc.Direction,
+					Segment:   formatSegment(window),
+					Data:      make(map[string]*FuncStats),
+				}
+				rollups[key] = r
+			}
+			r.add(doc)
+		}
+		return iter.Close()
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(rollups) == 0 {
+		return nil
+	}
+
+	return db.Run(RollupCollection(tenant, g), func(c *mgo.Collection) error {
+		bulk := c.Bulk()
+		bulk.Unordered()
+		for _, r := range rollups {
+			selector := bson.M{
+				"user_id":   r.UserID,
+				"direction": r.Direction,
+				"segment":   r.Segment,
+			}
+			bulk.Upsert(selector, r)
+		}
+
+		_, err := bulk.Run()
+		return err
+	})
+}
+
+// add folds the given document into the rollup document. Map keys are already
+// escaped in the stored documents, so they are used as is.
+func (r *Compaction) add(doc *Compaction) {
+	for funcName, st := range doc.Data {
+		if _, ok := r.Data[funcName]; !ok {
+			r.Data[funcName] = &FuncStats{}
+		}
+		r.Data[funcName].Add(st)
+	}
+
+	for seriesName, sr := range doc.Series {
+		if r.Series == nil {
+			r.Series = make(map[string]*Series)
+		}
+		if _, ok := r.Series[seriesName]; !ok {
+			r.Series[seriesName] = &Series{Func: sr.Func, Labels: sr.Labels}
+		}
+		r.Series[seriesName].Add(&sr.FuncStats)
+	}
+
+	r.Segments = append(r.Segments, doc.Segment)
+}
+
+func formatSegment(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// GetRollup returns the rollup values of the user in the window that holds the
+// given time.
+func GetRollup(db *MongoDB, tenant string, g Granularity, userID, dir string, t time.Time) (*Compaction, error) {
+	query := bson.M{
+		"user_id":   userID,
+		"direction": dir,
+		"segment":   formatSegment(g.Window(t)),
+	}
+	res := &Compaction{}
+	err := db.Run(RollupCollection(tenant, g), func(c *mgo.Collection) error {
+		return c.Find(query).One(res)
+	})
+	res.Data = unescapeStats(res.Data)
+	return res, err
+}
@@ -0,0 +1,88 @@
+package mongodb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGranularity_Window(t *testing.T) {
+	tm := time.Date(2017, time.March, 7, 6, 35, 0, 0, time.UTC)
+	tests := []struct {
+		g        Granularity
+		wantFrom time.Time
+		wantNext time.Time
+	}{
+		{
+			g:        Hour,
+			wantFrom: time.Date(2017, time.March, 7, 6, 0, 0, 0, time.UTC),
+			wantNext: time.Date(2017, time.March, 7, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			g:        Day,
+			wantFrom: time.Date(2017, time.March, 7, 0, 0, 0, 0, time.UTC),
+			wantNext: time.Date(2017, time.March, 8, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			g:        Month,
+			wantFrom: time.Date(2017, time.March, 1, 0, 0, 0, 0, time.UTC),
+			wantNext: time.Date(2017, time.April, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.g), func(t *testing.T) {
+			if got := tt.g.Window(tm); !got.Equal(tt.wantFrom) {
+				t.Errorf("Granularity.Window() = %v, want %v", got, tt.wantFrom)
+			}
+			if got := tt.g.Next(tm); !got.Equal(tt.wantNext) {
+				t.Errorf("Granularity.Next() = %v, want %v", got, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestCompaction_add(t *testing.T) {
+	r := &Compaction{Data: make(map[string]*FuncStats)}
+	docs := []*Compaction{
+		{
+			Segment: "1488866400",
+			Data: map[string]*FuncStats{
+				"fn": {Calls: 2, Duration: 10, Min: 4, Max: 6, Buckets: map[string]int64{"inf": 2}},
+			},
+			Series: map[string]*Series{
+				"fn{region=eu}": {
+					Func:      "fn",
+					Labels:    map[string]string{"region": "eu"},
+					FuncStats: FuncStats{Calls: 2, Duration: 10, Min: 4, Max: 6},
+				},
+			},
+		},
+		{
+			Segment: "1488866700",
+			Data: map[string]*FuncStats{
+				"fn": {Calls: 1, Duration: 3, Min: 3, Max: 3, Buckets: map[string]int64{"inf": 1}},
+			},
+		},
+	}
+	for _, doc := range docs {
+		r.add(doc)
+	}
+
+	want := &Compaction{
+		Data: map[string]*FuncStats{
+			"fn": {Calls: 3, Duration: 13, Min: 3, Max: 6, Buckets: map[string]int64{"inf": 3}},
+		},
+		Series: map[string]*Series{
+			"fn{region=eu}": {
+				Func:      "fn",
+				Labels:    map[string]string{"region": "eu"},
+				FuncStats: FuncStats{Calls: 2, Duration: 10, Min: 4, Max: 6},
+			},
+		},
+		Segments: []string{"1488866400", "1488866700"},
+	}
+
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("Compaction.add() = %+v, want %+v", r, want)
+	}
+}
@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ropelive/count/pkg/mongodb"
+)
+
+// RetentionSegments is the retention key of the segment documents. Rest of the
+// keys are the rollup granularities.
+const RetentionSegments = "segment"
+
+// RetentionConfig holds how long the compaction documents are kept per
+// granularity. Documents of the granularities without a retention are kept
+// forever.
+type RetentionConfig map[string]time.Duration
+
+// DefaultRetentionConfig is used when the retention is not configured. It
+// keeps every document forever, the documents are expired only when RETENTION
+// is set.
+var DefaultRetentionConfig = RetentionConfig{}
+
+// minRetentions hold the shortest retentions that keep the sources of the
+// rollups till their windows are over.
+var minRetentions = map[string]time.Duration{
+	RetentionSegments:    2 * time.Hour,
+	string(mongodb.Hour): 2 * 24 * time.Hour,
+	string(mongodb.Day):  62 * 24 * time.Hour,
+}
+
+// SourceRetention returns the retention of the documents that the rollups of
+// the granularity are rolled up from, zero if they are kept forever.
+func (r RetentionConfig) SourceRetention(g mongodb.Granularity) time.Duration {
+	for i, gr := range mongodb.Granularities {
+		if gr != g {
+			continue
+		}
+		if i == 0 {
+			return r[RetentionSegments]
+		}
+		return r[string(mongodb.Granularities[i-1])]
+	}
+	return 0
+}
+
+// ParseRetention parses the retentions in "segment=336h,hour=2160h" format.
+func ParseRetention(s string) (RetentionConfig, error) {
+	r := make(RetentionConfig)
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid retention: %q", part)
+		}
+
+		dur, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		r[strings.TrimSpace(kv[0])] = dur
+	}
+
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Validate checks if the retentions are known and long enough for the rollups.
+func (r RetentionConfig) Validate() error {
+	for key, dur := range r {
+		if !isRetentionKey(key) {
+			return fmt.Errorf("unknown retention: %q", key)
+		}
+
+		if dur < 0 {
+			return fmt.Errorf("retention of %q should not be negative", key)
+		}
+
+		if min := minRetentions[key]; dur != 0 && dur < min {
+			return fmt.Errorf("retention of %q should be at least %s", key, min)
+		}
+	}
+
+	return nil
+}
+
+func isRetentionKey(key string) bool {
+	if key == RetentionSegments {
+		return true
+	}
+	for _, g := range mongodb.Granularities {
+		if key == string(g) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ropelive/count/pkg/mongodb"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    RetentionConfig
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			s:    "",
+			want: RetentionConfig{},
+		},
+		{
+			name: "segments and rollups",
+			s:    "segment=336h, hour=2160h,day=0",
+			want: RetentionConfig{
+				"segment": 336 * time.Hour,
+				"hour":    2160 * time.Hour,
+				"day":     0,
+			},
+		},
+		{
+			name:    "unknown granularity",
+			s:       "week=336h",
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			s:       "segment=two weeks",
+			wantErr: true,
+		},
+		{
+			name:    "shorter than the rollup window",
+			s:       "day=720h",
+			wantErr: true,
+		},
+		{
+			name:    "negative",
+			s:       "month=-1h",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRetention(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRetention() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRetention() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetentionConfig_SourceRetention(t *testing.T) {
+	r := RetentionConfig{
+		RetentionSegments: 336 * time.Hour,
+		"hour":            2160 * time.Hour,
+	}
+
+	tests := []struct {
+		g    mongodb.Granularity
+		want time.Duration
+	}{
+		{g: mongodb.Hour, want: 336 * time.Hour},
+		{g: mongodb.Day, want: 2160 * time.Hour},
+		{g: mongodb.Month, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.g), func(t *testing.T) {
+			if got := r.SourceRetention(tt.g); got != tt.want {
+				t.Errorf("RetentionConfig.SourceRetention() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Tenants holds the signing key rings of the tenants. Default tenant, "", has
+// its own key ring, other tenants are loaded from the sub directories of the
+// tenants directory, eg: "<dir>/<tenant>/active".
+type Tenants struct {
+	dir       string
+	retention time.Duration
+
+	mu    sync.RWMutex
+	def   *KeyRing
+	rings map[string]*KeyRing
+}
+
+// NewTenants creates a Tenants with only the default tenant.
+func NewTenants(def *KeyRing) *Tenants {
+	return &Tenants{
+		def:   def,
+		rings: make(map[string]*KeyRing),
+	}
+}
+
+// LoadTenants loads the key rings of the tenants from the given directory.
+// Removed keys of the tenants are kept for verifying for the given retention.
+func LoadTenants(def *KeyRing, dir string, retention time.Duration) (*Tenants, error) {
+	t := NewTenants(def)
+	t.dir, t.retention = dir, retention
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload reloads the key ring of the default tenant and re-reads the tenants
+// directory. New tenants are added, the removed ones are dropped and the key
+// rings of the current ones are reloaded in place to keep their retired keys.
+func (t *Tenants) Reload() error {
+	if t.def.dir != "" {
+		if err := t.def.Reload(); err != nil {
+			return err
+		}
+	}
+
+	if t.dir == "" {
+		return nil
+	}
+
+	infos, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return err
+	}
+
+	rings := make(map[string]*KeyRing)
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+
+		tenant := info.Name()
+		if tenant == "" {
+			continue
+		}
+
+		if err := ValidateTenant(tenant); err != nil {
+			return err
+		}
+
+		t.mu.RLock()
+		ring, ok := t.rings[tenant]
+		t.mu.RUnlock()
+
+		if ok {
+			err = ring.Reload()
+		} else {
+			ring, err = LoadKeyRing(filepath.Join(t.dir, tenant), t.retention)
+		}
+
+		if err != nil {
+			return err
+		}
+		rings[tenant] = ring
+	}
+
+	t.mu.Lock()
+	t.rings = rings
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Watch reloads the tenants periodically till the done channel is closed.
+func (t *Tenants) Watch(interval time.Duration, done <-chan struct{}, onError func(error)) {
+	if t.dir == "" && t.def.dir == "" {
+		return
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+			if err := t.Reload(); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// KeyRing returns the key ring of the given tenant.
+func (t *Tenants) KeyRing(tenant string) (*KeyRing, error) {
+	if tenant == "" {
+		return t.def, nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	ring, ok := t.rings[tenant]
+	if !ok {
+		return nil, ErrUnknownTenant
+	}
+	return ring, nil
+}
+
+// VerificationKey implements VerificationKeys.
+func (t *Tenants) VerificationKey(tenant, kid string) (*SigningKey, error) {
+	ring, err := t.KeyRing(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return ring.lookup(kid)
+}
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestTenants_VerificationKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tenant := range []string{"acme", "globex"} {
+		if err := os.Mkdir(filepath.Join(dir, tenant), 0700); err != nil {
+			t.Fatalf("os.Mkdir() error = %v", err)
+		}
+		writeECKey(t, filepath.Join(dir, tenant), "key1")
+		writeActiveKey(t, filepath.Join(dir, tenant), "key1")
+	}
+
+	tenants, err := LoadTenants(NewKeyRing(DefaultSigningKey), dir, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadTenants() error = %v", err)
+	}
+
+	acme, err := tenants.KeyRing("acme")
+	if err != nil {
+		t.Fatalf("Tenants.KeyRing() error = %v", err)
+	}
+
+	token, err := SignJWT(acme.Active(), &JWTData{Source: "src", Target: "tgt", FuncName: "fn", Tenant: "acme"})
+	if err != nil {
+		t.Fatalf("SignJWT() error = %v", err)
+	}
+
+	claims, err := ParseJWT(log.NewNopLogger(), tenants, token)
+	if err != nil {
+		t.Fatalf("ParseJWT() error = %v", err)
+	}
+
+	if claims.Tenant != "acme" {
+		t.Errorf("ParseJWT().Tenant = %v, want acme", claims.Tenant)
+	}
+
+	// same kid of another tenant must not verify the token
+	forged, err := SignJWT(acme.Active(), &JWTData{Source: "src", Target: "tgt", FuncName: "fn", Tenant: "globex"})
+	if err != nil {
+		t.Fatalf("SignJWT() error = %v", err)
+	}
+
+	if _, err := ParseJWT(log.NewNopLogger(), tenants, forged); err == nil {
+		t.Errorf("ParseJWT() should fail for a token signed with another tenant's key")
+	}
+
+	if _, err := tenants.KeyRing("initech"); err != ErrUnknownTenant {
+		t.Errorf("Tenants.KeyRing() error = %v, want %v", err, ErrUnknownTenant)
+	}
+}
@@ -0,0 +1,190 @@
+package compactor
+
+import (
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/koding/redis"
+	"github.com/ropelive/count/pkg"
+	"github.com/ropelive/count/pkg/mongodb"
+)
+
+// processBatch claims a batch of members of the queue and merges them. Failed
+// members are put back to the queue and the first error is returned, members
+// that have failed too many times are dead-lettered without an error. Returns
+// errNotFound if the queue is empty.
+func (c *compactorService) processBatch(redisConn *redis.RedisSession, keyNames pkg.KeyNames, stats *runStats) error {
+	queueName := keyNames.CurrentCounterSet
+	members, claimID, err := claimBatch(redisConn, queueName, c.app.BatchSize(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	if len(members) == 0 {
+		return errNotFound
+	}
+
+	errs := c.mergeBatch(redisConn, keyNames, members, stats)
+
+	var merged, failed []string
+	var failedErrs []error
+	for i, member := range members {
+		if errs[i] == nil {
+			merged = append(merged, member)
+			continue
+		}
+
+		failed = append(failed, member)
+		failedErrs = append(failedErrs, errs[i])
+	}
+
+	// run goes on if all of the failed members are dead-lettered.
+	var firstErr error
+	requeued, err := c.fail(redisConn, keyNames, claimID, failed, failedErrs, stats)
+	if err != nil {
+		c.app.ErrorLog("msg", "error while trying to put the items back to process set after an unseccesful operation", "err", err.Error())
+	}
+	if err != nil || requeued != 0 {
+		firstErr = failedErrs[0]
+	}
+
+	released, err := release(redisConn, queueName, claimID, false, merged...)
+	if err != nil {
+		c.app.ErrorLog("msg", err.Error())
+		return err
+	}
+
+	if released != len(merged) {
+		c.app.ErrorLog("msg", "leases of some members have expired before they are processed, they might be processed again.", "expired", len(merged)-released)
+	}
+
+	return firstErr
+}
+
+// mergeBatch merges the hash maps of the given members like merge does, but
+// reads and deletes them with pipelines and writes them with a single bulk
+// write. Returns the errors of the members in the same order, the errors of
+// the pipelines and the bulk write are returned for all of their members.
+func (c *compactorService) mergeBatch(redisConn *redis.RedisSession, keyNames pkg.KeyNames, members []string, stats *runStats) []error {
+	errs := make([]error, len(members))
+	fail := func(err error, idxs []int) []error {
+		for _, i := range idxs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	all := make([]int, len(members))
+	sources := make([]string, len(members))
+	for i, member := range members {
+		all[i] = i
+		sources[i] = keyNames.HashSetName(member)
+	}
+
+	conn := redisConn.Pool().Get()
+	defer conn.Close()
+
+	for i := range members {
+		nonce, err := newNonce()
+		if err != nil {
+			return fail(err, all)
+		}
+
+		source := redisConn.AddPrefix(sources[i])
+		if err := conn.Send("HSETNX", source, pkg.NonceField, nonce); err != nil {
+			return fail(err, all)
+		}
+		if err := conn.Send("HGETALL", source); err != nil {
+			return fail(err, all)
+		}
+	}
+
+	replies, err := redigo.Values(conn.Do(""))
+	if err != nil {
+		return fail(err, all)
+	}
+
+	var tenant string
+	written := make([]*mongodb.CompactionUpsert, len(members))
+	var upserts []*mongodb.CompactionUpsert
+	var upserted []int
+	for i := range members {
+		fns, err := redigo.Int64Map(replies[2*i+1], nil)
+		if err != nil {
+			errs[i] = &memberError{err}
+			continue
+		}
+
+		// hash map has only the nonce, nothing to merge.
+		if len(fns) <= 1 {
+			continue
+		}
+
+		parsedKey, u, err := compactionUpsert(sources[i], fns)
+		if err != nil {
+			errs[i] = &memberError{err}
+			continue
+		}
+
+		tenant = parsedKey.Tenant
+		upserts = append(upserts, u)
+		upserted = append(upserted, i)
+	}
+
+	if len(upserts) != 0 {
+		upsertErrs, err := mongodb.BulkUpsertCompactions(c.app.MustGetMongo(), tenant, upserts)
+		if err != nil {
+			return fail(err, upserted)
+		}
+
+		for j, err := range upsertErrs {
+			switch err {
+			case nil:
+				written[upserted[j]] = upserts[j]
+			case mongodb.ErrAlreadyApplied:
+				c.app.InfoLog("msg", "counter hash map is already merged, deleting it", "source", sources[upserted[j]])
+			default:
+				// bulk write has succeeded, so the upsert itself is rejected.
+				errs[upserted[j]] = &memberError{err}
+			}
+		}
+	}
+
+	var deleted []int
+	for i := range members {
+		if errs[i] != nil {
+			continue
+		}
+
+		if err := conn.Send("DEL", redisConn.AddPrefix(sources[i])); err != nil {
+			return fail(err, all)
+		}
+		deleted = append(deleted, i)
+	}
+
+	if len(deleted) == 0 {
+		return errs
+	}
+
+	replies, err = redigo.Values(conn.Do(""))
+	if err != nil {
+		return fail(err, deleted)
+	}
+
+	queueKey := pkg.ParseKeyName(keyNames.CurrentCounterSet)
+	for j, i := range deleted {
+		n, err := redigo.Int(replies[j], nil)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		stats.merged(queueKey.Tenant, queueKey.Direction, written[i])
+
+		if n == 0 {
+			c.app.Logger.Log("msg", "we should be able to delete the counter hash map here, but failed. someone might already have deleted it..")
+		}
+	}
+
+	return errs
+}
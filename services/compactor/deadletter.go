@@ -0,0 +1,278 @@
+package compactor
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/koding/redis"
+	"github.com/ropelive/count/pkg"
+)
+
+// deadLettersKey holds the dead letters by their ids.
+const deadLettersKey = "hash:compactor:deadletters"
+
+// failuresTTL is the expiry of the failure counts of a queue, the counts of
+// the members that have not failed again are forgotten.
+const failuresTTL = 24 * time.Hour
+
+// deadLettered counts the members that are moved to the dead letters.
+var deadLettered = expvar.NewInt("compactor_dead_lettered")
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter holds a member that has failed to be merged too many times. It is
+// not processed again till it is retried.
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	Queue    string    `json:"queue"`
+	Member   string    `json:"member"`
+	Source   string    `json:"source"`
+	Err      string    `json:"err"`
+	Failures int       `json:"failures"`
+	DeadAt   time.Time `json:"deadAt"`
+}
+
+// keyNames returns the key names of the queue of the dead letter.
+func (l *DeadLetter) keyNames() pkg.KeyNames {
+	return pkg.KeyNames{
+		CurrentCounterSet:  l.Queue,
+		CurrentCounterHSet: strings.TrimSuffix(l.Source, ":"+l.Member),
+	}
+}
+
+// deadLetterID returns the id of the dead letter of the member of the queue.
+func deadLetterID(queueName, member string) string {
+	h := sha1.Sum([]byte(queueName + "\x00" + member))
+	return hex.EncodeToString(h[:])
+}
+
+// memberError is an error that is caused by the member itself, eg: a counter
+// hash map that can not be parsed or a compaction document that is rejected.
+// Only these errors count towards the failures of a member, the rest are
+// caused by redis or mongo and the member is put back to the queue as is.
+type memberError struct {
+	err error
+}
+
+func (e *memberError) Error() string { return e.err.Error() }
+
+// fail handles the failed members of a claim. Members are put back to the
+// queue till they fail the configured number of times, then they are moved to
+// the dead letters with their last errors. Returns the number of the members
+// that are put back to the queue.
+func (c *compactorService) fail(redisConn *redis.RedisSession, keyNames pkg.KeyNames, claimID string, members []string, errs []error, stats *runStats) (int, error) {
+	var counted, retried []string
+	var countedErrs []error
+	for i, member := range members {
+		if _, ok := errs[i].(*memberError); !ok {
+			retried = append(retried, member)
+			continue
+		}
+
+		counted = append(counted, member)
+		countedErrs = append(countedErrs, errs[i])
+	}
+
+	alive, dead, err := c.countFailures(redisConn, keyNames, counted, countedErrs)
+	if err != nil {
+		return 0, err
+	}
+	retried = append(retried, alive...)
+
+	if len(dead) != 0 {
+		if _, err := release(redisConn, keyNames.CurrentCounterSet, claimID, false, dead...); err != nil {
+			return 0, err
+		}
+
+		deadLettered.Add(int64(len(dead)))
+		stats.deadLettered(len(dead))
+	}
+
+	requeued, err := release(redisConn, keyNames.CurrentCounterSet, claimID, true, retried...)
+	if err != nil {
+		return 0, err
+	}
+
+	stats.requeued(requeued)
+	return requeued, nil
+}
+
+// countFailures increments the failure counts of the given members and records
+// the dead letters of the ones that have failed too many times. Returns the
+// members that can be retried and the dead-lettered ones.
+func (c *compactorService) countFailures(redisConn *redis.RedisSession, keyNames pkg.KeyNames, members []string, errs []error) (alive, dead []string, err error) {
+	if len(members) == 0 {
+		return nil, nil, nil
+	}
+
+	queueName := keyNames.CurrentCounterSet
+	failuresKey := redisConn.AddPrefix(queueName + "_failures")
+
+	conn := redisConn.Pool().Get()
+	defer conn.Close()
+
+	for _, member := range members {
+		if err := conn.Send("HINCRBY", failuresKey, member, 1); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := conn.Send("EXPIRE", failuresKey, int(failuresTTL/time.Second)); err != nil {
+		return nil, nil, err
+	}
+
+	replies, err := redigo.Ints(conn.Do(""))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, member := range members {
+		if replies[i] < c.app.MaxFailures() {
+			alive = append(alive, member)
+			continue
+		}
+
+		letter := &DeadLetter{
+			ID:       deadLetterID(queueName, member),
+			Queue:    queueName,
+			Member:   member,
+			Source:   keyNames.HashSetName(member),
+			Err:      errs[i].Error(),
+			Failures: replies[i],
+			DeadAt:   time.Now().UTC(),
+		}
+
+		data, err := json.Marshal(letter)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// dead letter is recorded before the member leaves the processing
+		// set, so a crash in between can only process the member again.
+		if err := conn.Send("HSET", redisConn.AddPrefix(deadLettersKey), letter.ID, data); err != nil {
+			return nil, nil, err
+		}
+		if err := conn.Send("HDEL", failuresKey, member); err != nil {
+			return nil, nil, err
+		}
+		dead = append(dead, member)
+
+		c.app.ErrorLog("msg", "member has failed too many times, moving it to the dead letters", "queue", queueName, "member", member, "err", letter.Err)
+	}
+
+	if len(dead) != 0 {
+		if _, err := conn.Do(""); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return alive, dead, nil
+}
+
+// DeadLetters returns the dead letters ordered by their queues and members.
+func (c *compactorService) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	redisConn := c.app.MustGetRedis()
+
+	vals, err := redigo.StringMap(redisConn.Do("HGETALL", redisConn.AddPrefix(deadLettersKey)))
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(vals))
+	for id, val := range vals {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(val), &letter); err != nil {
+			return nil, fmt.Errorf("dead letter %s: %s", id, err)
+		}
+		letters = append(letters, letter)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].Queue != letters[j].Queue {
+			return letters[i].Queue < letters[j].Queue
+		}
+		return letters[i].Member < letters[j].Member
+	})
+	return letters, nil
+}
+
+// RetryDeadLetter puts the member of the dead letter back to its queue and
+// processes it right away, as the runs might not cover its segment anymore. If
+// it fails again, it is left in its queue with a fresh failure count and the
+// error is returned, a job with the range of its segment can retry it.
+func (c *compactorService) RetryDeadLetter(ctx context.Context, id string) error {
+	redisConn := c.app.MustGetRedis()
+
+	letter, err := c.deadLetter(redisConn, id)
+	if err != nil {
+		return err
+	}
+
+	parsedKey, err := parseKeyName(letter.Source)
+	if err != nil {
+		return err
+	}
+
+	// a retry might come before any run of this compactor.
+	if err := c.prepareTenants([]string{parsedKey.Tenant}); err != nil {
+		return err
+	}
+
+	if _, err := redisConn.AddSetMembers(letter.Queue, letter.Member); err != nil {
+		return err
+	}
+
+	if _, err := redisConn.Do("HDEL", redisConn.AddPrefix(deadLettersKey), id); err != nil {
+		return err
+	}
+
+	err = c.processMember(redisConn, letter.keyNames(), letter.Member, newRunStats(&ProcessResult{}))
+	if err == errNotFound {
+		// a run has claimed the member in the mean time.
+		return nil
+	}
+	return err
+}
+
+// DiscardDeadLetter deletes the dead letter with the counter hash map of its
+// member, the values of the member are lost.
+func (c *compactorService) DiscardDeadLetter(ctx context.Context, id string) error {
+	redisConn := c.app.MustGetRedis()
+
+	letter, err := c.deadLetter(redisConn, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := redisConn.Del(letter.Source); err != nil {
+		return err
+	}
+
+	_, err = redisConn.Do("HDEL", redisConn.AddPrefix(deadLettersKey), id)
+	return err
+}
+
+func (c *compactorService) deadLetter(redisConn *redis.RedisSession, id string) (*DeadLetter, error) {
+	val, err := redigo.Bytes(redisConn.Do("HGET", redisConn.AddPrefix(deadLettersKey), id))
+	if err == redis.ErrNil {
+		return nil, errDeadLetterNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	letter := &DeadLetter{}
+	if err := json.Unmarshal(val, letter); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
@@ -0,0 +1,195 @@
+package compactor
+
+import (
+	"context"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/koding/redis"
+	"github.com/ropelive/count/pkg"
+	"github.com/ropelive/count/pkg/mongodb"
+)
+
+// dryRun returns the merges that would be done for the members of the given
+// queues, and for the members of their processing sets with the expired
+// leases, as the run puts them back to the queues first. Members are not
+// claimed, so nothing is changed in redis or mongo. Only the given member is
+// reported if it is set.
+func (c *compactorService) dryRun(ctx context.Context, redisConn *redis.RedisSession, jobs []queueJob, member string) ([]Merge, error) {
+	now := time.Now()
+
+	var merges []Merge
+	for _, job := range jobs {
+		queueName := job.keyNames.CurrentCounterSet
+
+		err := c.scanMembers(ctx, redisConn, queueName, member, func(members []string) error {
+			batch, err := c.dryMerges(redisConn, job.keyNames, members)
+			merges = append(merges, batch...)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.scanMembers(ctx, redisConn, queueName+"_processing", member, func(members []string) error {
+			stranded, err := expiredLeases(redisConn, queueName, members, now)
+			if err != nil || len(stranded) == 0 {
+				return err
+			}
+
+			batch, err := c.dryMerges(redisConn, job.keyNames, stranded)
+			for i := range batch {
+				batch[i].Stranded = true
+			}
+			merges = append(merges, batch...)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return merges, nil
+}
+
+// scanMembers passes the members of the set to the given function in batches
+// of the configured batch size, or only the given member if it is set and in
+// the set.
+func (c *compactorService) scanMembers(ctx context.Context, redisConn *redis.RedisSession, setName, member string, fn func(members []string) error) error {
+	if member != "" {
+		ok, err := redisConn.IsSetMember(setName, member)
+		if err != nil || ok == 0 {
+			return err
+		}
+		return fn([]string{member})
+	}
+
+	// SSCAN might return a member more than once.
+	seen := make(map[string]struct{})
+	for cursor := "0"; ; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		reply, err := redigo.Values(redisConn.Do("SSCAN", redisConn.AddPrefix(setName), cursor, "COUNT", c.app.BatchSize()))
+		if err != nil {
+			return err
+		}
+
+		var scanned []string
+		if _, err := redigo.Scan(reply, &cursor, &scanned); err != nil {
+			return err
+		}
+
+		members := scanned[:0]
+		for _, m := range scanned {
+			if _, ok := seen[m]; !ok {
+				seen[m] = struct{}{}
+				members = append(members, m)
+			}
+		}
+
+		if len(members) != 0 {
+			if err := fn(members); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// expiredLeases returns the given members of the processing set of the queue
+// that would be put back to the queue by the reaper, the ones with the expired
+// leases and the ones without any lease.
+func expiredLeases(redisConn *redis.RedisSession, queueName string, members []string, now time.Time) ([]string, error) {
+	conn := redisConn.Pool().Get()
+	defer conn.Close()
+
+	leasesKey := redisConn.AddPrefix(queueName + "_leases")
+	for _, m := range members {
+		if err := conn.Send("ZSCORE", leasesKey, m); err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := redigo.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+
+	nowMillis := now.UnixNano() / int64(time.Millisecond)
+
+	var expired []string
+	for i, m := range members {
+		deadline, err := redigo.Int64(replies[i], nil)
+		if err == redigo.ErrNil || (err == nil && deadline <= nowMillis) {
+			expired = append(expired, m)
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expired, nil
+}
+
+// dryMerges returns the merges of the given members of the queue with a
+// pipelined read of their hash maps.
+func (c *compactorService) dryMerges(redisConn *redis.RedisSession, keyNames pkg.KeyNames, members []string) ([]Merge, error) {
+	conn := redisConn.Pool().Get()
+	defer conn.Close()
+
+	for _, m := range members {
+		if err := conn.Send("HGETALL", redisConn.AddPrefix(keyNames.HashSetName(m))); err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := redigo.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+
+	merges := make([]Merge, 0, len(members))
+	for i, m := range members {
+		source := keyNames.HashSetName(m)
+		merge := Merge{
+			Member: m,
+			Source: source,
+		}
+
+		parsedKey, err := parseKeyName(source)
+		if err == nil {
+			merge.Tenant = parsedKey.Tenant
+			merge.Collection = mongodb.CompactionCollection(parsedKey.Tenant)
+			merge.Direction = parsedKey.Direction
+			merge.Segment = parsedKey.Segment
+		}
+
+		var fns map[string]int64
+		if err == nil {
+			fns, err = redigo.Int64Map(replies[i], nil)
+		}
+
+		if err == nil {
+			var u *mongodb.CompactionUpsert
+			if _, u, err = compactionUpsert(source, fns); err == nil {
+				merge.Data = u.Data
+			}
+		}
+
+		if err != nil {
+			merge.Err = err.Error()
+		}
+
+		merges = append(merges, merge)
+	}
+
+	return merges, nil
+}
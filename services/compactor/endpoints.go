@@ -5,30 +5,133 @@ import (
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
+	"github.com/ropelive/count/pkg/mongodb"
 )
 
 // Endpoints collects all of the endpoints that compose a compactor service.
 type Endpoints struct {
-	ProcessEndpoint endpoint.Endpoint
+	ProcessEndpoint     endpoint.Endpoint
+	RollupEndpoint      endpoint.Endpoint
+	CheckpointsEndpoint endpoint.Endpoint
+	SubmitJobEndpoint   endpoint.Endpoint
+	GetJobEndpoint      endpoint.Endpoint
+	CancelJobEndpoint   endpoint.Endpoint
+
+	DeadLettersEndpoint       endpoint.Endpoint
+	RetryDeadLetterEndpoint   endpoint.Endpoint
+	DiscardDeadLetterEndpoint endpoint.Endpoint
 }
 
 // Process implements Service. Primarily useful in a client.
-func (e Endpoints) Process(ctx context.Context, req ProcessRequest) error {
+func (e Endpoints) Process(ctx context.Context, req ProcessRequest) (*ProcessResult, error) {
 	response, err := e.ProcessEndpoint(ctx, req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	resp := response.(ProcessResponse)
+	return resp.ProcessResult, resp.Err
+}
+
+// Rollup implements Service. Primarily useful in a client.
+func (e Endpoints) Rollup(ctx context.Context, req RollupRequest) error {
+	response, err := e.RollupEndpoint(ctx, req)
+	if err != nil {
+		return err
+	}
+	resp := response.(RollupResponse)
 	return resp.Err
 }
 
+// Checkpoints implements Service. Primarily useful in a client.
+func (e Endpoints) Checkpoints(ctx context.Context) ([]CheckpointStatus, error) {
+	response, err := e.CheckpointsEndpoint(ctx, CheckpointsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(CheckpointsResponse)
+	return resp.Checkpoints, resp.Err
+}
+
 // ProcessRequest holds the values for processing the compaction.
 type ProcessRequest struct {
 	StartAt time.Time `json:"startAt"`
+
+	// From and To set the range of the segments to process, both of them are
+	// inclusive. To defaults to the last processible segment of StartAt, From
+	// defaults to the configured lookback before To.
+	From time.Time `json:"from,omitempty"`
+	To   time.Time `json:"to,omitempty"`
+
+	// Direction limits the processing to the src or dst queues.
+	Direction string `json:"direction,omitempty"`
+
+	// Member limits the processing to a single source or target.
+	Member string `json:"member,omitempty"`
+
+	// DryRun reports the merges that would be done without changing anything.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// ProcessResult holds the outcome of a Process call.
+type ProcessResult struct {
+	// Segments holds the number of segments that are visited out of the
+	// total number of segments in the range.
+	Segments int `json:"segments"`
+	Total    int `json:"total"`
+
+	// Merged holds the number of merged members per direction.
+	Merged map[string]int `json:"merged,omitempty"`
+
+	// Functions and Duration hold the number of functions and their total
+	// duration that are written to the compaction documents.
+	Functions int           `json:"functions"`
+	Duration  time.Duration `json:"duration"`
+
+	// Requeued holds the number of members that are put back to their queues
+	// after an error.
+	Requeued int `json:"requeued"`
+
+	// DeadLettered holds the number of members that are moved to the dead
+	// letters after failing too many times.
+	DeadLettered int `json:"deadLettered"`
+
+	// Elapsed holds the duration of the run.
+	Elapsed time.Duration `json:"elapsed"`
+
+	// OldestSegment holds the oldest visited segment that still has members
+	// to process, zero if all of them are drained.
+	OldestSegment time.Time `json:"oldestSegment,omitempty"`
+
+	// Planned holds the number of the merges that would be done by a dry
+	// run.
+	Planned int `json:"planned,omitempty"`
+
+	// Merges holds the merges that would be done by a dry run. Results of
+	// the jobs hold only a sample of them, a dry run of a narrower range or
+	// a member returns the rest.
+	Merges []Merge `json:"merges,omitempty"`
+}
+
+// Merge holds the values of a counter hash map that are merged into a
+// compaction document.
+type Merge struct {
+	Tenant     string                        `json:"tenant,omitempty"`
+	Member     string                        `json:"member"`
+	Source     string                        `json:"source"`
+	Collection string                        `json:"collection"`
+	Direction  string                        `json:"direction"`
+	Segment    string                        `json:"segment"`
+	Data       map[string]*mongodb.FuncStats `json:"data,omitempty"`
+	Err        string                        `json:"err,omitempty"`
+
+	// Stranded is set for the members of the processing sets with the
+	// expired leases, they are put back to their queues before the merge.
+	Stranded bool `json:"stranded,omitempty"`
 }
 
 // ProcessResponse holds the response data for the Process handler
 type ProcessResponse struct {
+	*ProcessResult
 	Err error `json:"err,omitempty"`
 }
 
@@ -39,7 +142,214 @@ func (r ProcessResponse) error() error { return r.Err }
 func MakeProcessEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(ProcessRequest)
-		e := s.Process(ctx, req)
-		return ProcessResponse{Err: e}, nil
+		res, e := s.Process(ctx, req)
+		return ProcessResponse{ProcessResult: res, Err: e}, nil
+	}
+}
+
+// RollupRequest holds the range of the windows to roll up. Rollups are
+// re-computed from their sources, so the windows that might have lost some of
+// their sources to the retention are skipped.
+type RollupRequest struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to,omitempty"`
+}
+
+// RollupResponse holds the response data for the Rollup handler
+type RollupResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r RollupResponse) error() error { return r.Err }
+
+// MakeRollupEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeRollupEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(RollupRequest)
+		e := s.Rollup(ctx, req)
+		return RollupResponse{Err: e}, nil
+	}
+}
+
+// CheckpointStatus holds the checkpoint of a direction and its lag behind the
+// last processible segment in nano secs.
+type CheckpointStatus struct {
+	mongodb.Checkpoint
+	Lag time.Duration `json:"lag"`
+}
+
+// CheckpointsRequest represents a request for the compactor checkpoints.
+type CheckpointsRequest struct{}
+
+// CheckpointsResponse holds the response data for the Checkpoints handler
+type CheckpointsResponse struct {
+	Checkpoints []CheckpointStatus `json:"checkpoints"`
+	Err         error              `json:"err,omitempty"`
+}
+
+func (r CheckpointsResponse) error() error { return r.Err }
+
+// MakeCheckpointsEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeCheckpointsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		checkpoints, e := s.Checkpoints(ctx)
+		return CheckpointsResponse{Checkpoints: checkpoints, Err: e}, nil
+	}
+}
+
+// SubmitJob implements Service. Primarily useful in a client.
+func (e Endpoints) SubmitJob(ctx context.Context, req ProcessRequest) (*mongodb.Job, error) {
+	response, err := e.SubmitJobEndpoint(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(JobResponse)
+	return resp.Job, resp.Err
+}
+
+// GetJob implements Service. Primarily useful in a client.
+func (e Endpoints) GetJob(ctx context.Context, id string) (*mongodb.Job, error) {
+	response, err := e.GetJobEndpoint(ctx, JobRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(JobResponse)
+	return resp.Job, resp.Err
+}
+
+// CancelJob implements Service. Primarily useful in a client.
+func (e Endpoints) CancelJob(ctx context.Context, id string) (*mongodb.Job, error) {
+	response, err := e.CancelJobEndpoint(ctx, JobRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(JobResponse)
+	return resp.Job, resp.Err
+}
+
+// JobRequest represents a request for a job.
+type JobRequest struct {
+	ID string `json:"id"`
+}
+
+// JobResponse holds the response data for the job handlers.
+type JobResponse struct {
+	Job *mongodb.Job `json:"job,omitempty"`
+	Err error        `json:"err,omitempty"`
+}
+
+func (r JobResponse) error() error { return r.Err }
+
+// MakeSubmitJobEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeSubmitJobEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(ProcessRequest)
+		job, e := s.SubmitJob(ctx, req)
+		return JobResponse{Job: job, Err: e}, nil
+	}
+}
+
+// MakeGetJobEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeGetJobEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(JobRequest)
+		job, e := s.GetJob(ctx, req.ID)
+		return JobResponse{Job: job, Err: e}, nil
+	}
+}
+
+// MakeCancelJobEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeCancelJobEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(JobRequest)
+		job, e := s.CancelJob(ctx, req.ID)
+		return JobResponse{Job: job, Err: e}, nil
+	}
+}
+
+// DeadLetters implements Service. Primarily useful in a client.
+func (e Endpoints) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	response, err := e.DeadLettersEndpoint(ctx, DeadLettersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(DeadLettersResponse)
+	return resp.DeadLetters, resp.Err
+}
+
+// RetryDeadLetter implements Service. Primarily useful in a client.
+func (e Endpoints) RetryDeadLetter(ctx context.Context, id string) error {
+	response, err := e.RetryDeadLetterEndpoint(ctx, DeadLetterRequest{ID: id})
+	if err != nil {
+		return err
+	}
+	resp := response.(DeadLetterResponse)
+	return resp.Err
+}
+
+// DiscardDeadLetter implements Service. Primarily useful in a client.
+func (e Endpoints) DiscardDeadLetter(ctx context.Context, id string) error {
+	response, err := e.DiscardDeadLetterEndpoint(ctx, DeadLetterRequest{ID: id})
+	if err != nil {
+		return err
+	}
+	resp := response.(DeadLetterResponse)
+	return resp.Err
+}
+
+// DeadLettersRequest represents a request for the dead letters.
+type DeadLettersRequest struct{}
+
+// DeadLettersResponse holds the response data for the DeadLetters handler
+type DeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"deadLetters"`
+	Err         error        `json:"err,omitempty"`
+}
+
+func (r DeadLettersResponse) error() error { return r.Err }
+
+// DeadLetterRequest represents a request for a dead letter.
+type DeadLetterRequest struct {
+	ID string `json:"id"`
+}
+
+// DeadLetterResponse holds the response data for the dead letter handlers.
+type DeadLetterResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r DeadLetterResponse) error() error { return r.Err }
+
+// MakeDeadLettersEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeDeadLettersEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		letters, e := s.DeadLetters(ctx)
+		return DeadLettersResponse{DeadLetters: letters, Err: e}, nil
+	}
+}
+
+// MakeRetryDeadLetterEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeRetryDeadLetterEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(DeadLetterRequest)
+		e := s.RetryDeadLetter(ctx, req.ID)
+		return DeadLetterResponse{Err: e}, nil
+	}
+}
+
+// MakeDiscardDeadLetterEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeDiscardDeadLetterEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(DeadLetterRequest)
+		e := s.DiscardDeadLetter(ctx, req.ID)
+		return DeadLetterResponse{Err: e}, nil
 	}
 }
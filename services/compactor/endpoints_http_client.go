@@ -30,7 +30,16 @@ func MakeHTTPClientEndpoints(instance string) (Endpoints, error) {
 	// encoders for each endpoint.
 
 	return Endpoints{
-		ProcessEndpoint: httptransport.NewClient("POST", tgt, encodeProcessRequest, decodeProcessResponse, options...).Endpoint(),
+		ProcessEndpoint:     httptransport.NewClient("POST", tgt, encodeProcessRequest, decodeProcessResponse, options...).Endpoint(),
+		RollupEndpoint:      httptransport.NewClient("POST", tgt, encodeRollupRequest, decodeRollupResponse, options...).Endpoint(),
+		CheckpointsEndpoint: httptransport.NewClient("GET", tgt, encodeCheckpointsRequest, decodeCheckpointsResponse, options...).Endpoint(),
+		SubmitJobEndpoint:   httptransport.NewClient("POST", tgt, encodeSubmitJobRequest, decodeJobResponse, options...).Endpoint(),
+		GetJobEndpoint:      httptransport.NewClient("GET", tgt, encodeGetJobRequest, decodeJobResponse, options...).Endpoint(),
+		CancelJobEndpoint:   httptransport.NewClient("DELETE", tgt, encodeCancelJobRequest, decodeJobResponse, options...).Endpoint(),
+
+		DeadLettersEndpoint:       httptransport.NewClient("GET", tgt, encodeDeadLettersRequest, decodeDeadLettersResponse, options...).Endpoint(),
+		RetryDeadLetterEndpoint:   httptransport.NewClient("POST", tgt, encodeRetryDeadLetterRequest, decodeDeadLetterResponse, options...).Endpoint(),
+		DiscardDeadLetterEndpoint: httptransport.NewClient("DELETE", tgt, encodeDiscardDeadLetterRequest, decodeDeadLetterResponse, options...).Endpoint(),
 	}, nil
 }
 
@@ -44,3 +53,77 @@ func decodeProcessResponse(_ context.Context, resp *http.Response) (interface{},
 	err := json.NewDecoder(resp.Body).Decode(&response)
 	return response, err
 }
+
+func encodeRollupRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	req.Method, req.URL.Path = "POST", "/rollup"
+	return encodeRequest(ctx, req, request)
+}
+
+func decodeRollupResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response RollupResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func encodeCheckpointsRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	req.Method, req.URL.Path = "GET", "/checkpoints"
+	return nil
+}
+
+func decodeCheckpointsResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response CheckpointsResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func encodeSubmitJobRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	req.Method, req.URL.Path = "POST", "/jobs"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeGetJobRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	r := request.(JobRequest)
+	req.Method, req.URL.Path = "GET", "/jobs/"+url.PathEscape(r.ID)
+	return nil
+}
+
+func encodeCancelJobRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	r := request.(JobRequest)
+	req.Method, req.URL.Path = "DELETE", "/jobs/"+url.PathEscape(r.ID)
+	return nil
+}
+
+func decodeJobResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response JobResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func encodeDeadLettersRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	req.Method, req.URL.Path = "GET", "/deadletters"
+	return nil
+}
+
+func decodeDeadLettersResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response DeadLettersResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func encodeRetryDeadLetterRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	r := request.(DeadLetterRequest)
+	req.Method, req.URL.Path = "POST", "/deadletters/"+url.PathEscape(r.ID)+"/retry"
+	return nil
+}
+
+func encodeDiscardDeadLetterRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	r := request.(DeadLetterRequest)
+	req.Method, req.URL.Path = "DELETE", "/deadletters/"+url.PathEscape(r.ID)
+	return nil
+}
+
+func decodeDeadLetterResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response DeadLetterResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
@@ -0,0 +1,151 @@
+package compactor
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/ropelive/count/pkg"
+	"github.com/ropelive/count/pkg/mongodb"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// jobSyncInterval is the interval of saving the progress of a running job
+	// and checking whether it is cancelled.
+	jobSyncInterval = 5 * time.Second
+
+	// jobStaleAfter is the duration after which a running job that is not
+	// updated is considered abandoned.
+	jobStaleAfter = 10 * jobSyncInterval
+)
+
+// SubmitJob starts processing the request in the background and returns its
+// job. A job without a range fails if another compactor is the leader.
+func (c *compactorService) SubmitJob(ctx context.Context, p ProcessRequest) (*mongodb.Job, error) {
+	if p.Direction != "" && p.Direction != pkg.DirectionSrc && p.Direction != pkg.DirectionDst {
+		return nil, errInvalidDirection
+	}
+
+	req, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := mongodb.InsertJob(c.app.MustGetMongo(), owner, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// job outlives the request that has submitted it.
+	jobCtx, cancel := context.WithCancel(context.Background())
+	c.jobs.Store(job.ID.Hex(), cancel)
+
+	go func() {
+		defer c.jobs.Delete(job.ID.Hex())
+		defer cancel()
+		c.runJob(jobCtx, cancel, job.ID, p)
+	}()
+
+	return job, nil
+}
+
+// GetJob returns the job with the given id.
+func (c *compactorService) GetJob(ctx context.Context, id string) (*mongodb.Job, error) {
+	return mongodb.GetJob(c.app.MustGetMongo(), id)
+}
+
+// CancelJob cancels the job with the given id. Job is cancelled right away if
+// it is run by this compactor, otherwise its compactor notices the
+// cancellation when it saves the progress.
+func (c *compactorService) CancelJob(ctx context.Context, id string) (*mongodb.Job, error) {
+	job, err := mongodb.CancelJob(c.app.MustGetMongo(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	if cancel, ok := c.jobs.Load(id); ok {
+		cancel.(context.CancelFunc)()
+	}
+
+	return job, nil
+}
+
+// runJob processes the request of the job, saves its progress periodically and
+// records its outcome.
+func (c *compactorService) runJob(ctx context.Context, cancel context.CancelFunc, id bson.ObjectId, p ProcessRequest) {
+	stats := newRunStats(&ProcessResult{})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.run(ctx, p, stats)
+	}()
+
+	t := time.NewTicker(jobSyncInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			c.finishJob(ctx, id, stats, err)
+			return
+		case <-t.C:
+		}
+
+		result, err := json.Marshal(stats.snapshot())
+		if err != nil {
+			c.app.ErrorLog("msg", "could not encode the job result", "job", id.Hex(), "err", err.Error())
+			continue
+		}
+
+		job, err := mongodb.UpdateJob(c.app.MustGetMongo(), id, result)
+		if err != nil {
+			c.app.ErrorLog("msg", "could not save the job progress", "job", id.Hex(), "err", err.Error())
+			continue
+		}
+
+		if job.CancelRequested {
+			cancel()
+		}
+	}
+}
+
+// abandonJobs marks the running jobs that are not updated for a while as
+// failed. It is done by the leader in its periodic runs.
+func (c *compactorService) abandonJobs() {
+	abandoned, err := mongodb.AbandonJobs(c.app.MustGetMongo(), time.Now().Add(-jobStaleAfter))
+	if err != nil {
+		c.app.ErrorLog("msg", "could not abandon the stale jobs", "err", err.Error())
+		return
+	}
+
+	if abandoned != 0 {
+		c.app.WarnLog("msg", "abandoned the stale jobs", "abandoned", abandoned)
+	}
+}
+
+func (c *compactorService) finishJob(ctx context.Context, id bson.ObjectId, stats *runStats, runErr error) {
+	status, errMsg := mongodb.JobDone, ""
+	switch {
+	case runErr != nil && ctx.Err() == context.Canceled:
+		status, errMsg = mongodb.JobCancelled, runErr.Error()
+	case runErr != nil:
+		status, errMsg = mongodb.JobFailed, runErr.Error()
+	}
+
+	result, err := json.Marshal(stats.snapshot())
+	if err != nil {
+		c.app.ErrorLog("msg", "could not encode the job result", "job", id.Hex(), "err", err.Error())
+	}
+
+	err = mongodb.FinishJob(c.app.MustGetMongo(), id, status, result, errMsg)
+	if err == nil {
+		return
+	}
+	c.app.ErrorLog("msg", "could not save the job outcome", "job", id.Hex(), "err", err.Error())
+
+	// the job should not be left running, it is failed without its result.
+	errMsg = "could not save the job result: " + err.Error()
+	if err := mongodb.FinishJob(c.app.MustGetMongo(), id, mongodb.JobFailed, nil, errMsg); err != nil {
+		c.app.ErrorLog("msg", "could not fail the job", "job", id.Hex(), "err", err.Error())
+	}
+}
@@ -0,0 +1,108 @@
+package compactor
+
+import (
+	"context"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/koding/redis"
+)
+
+const (
+	// leaderKey holds the claim id of the compactor that is the leader.
+	leaderKey = "str:compactor:leader"
+
+	// fencingKey holds the last fencing token given to a leader.
+	fencingKey = "str:compactor:fencing"
+
+	// leaderTTL is how long the leadership lasts without a renewal.
+	leaderTTL = 30 * time.Second
+)
+
+// acquireScript takes the leadership if there is no leader and returns a new
+// fencing token. Returns 0 if there is a leader already.
+//
+// KEYS[1] leader key, KEYS[2] fencing key, ARGV[1] claim id, ARGV[2] ttl in
+// millis.
+const acquireScript = `
+if not redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 0
+end
+return redis.call("INCR", KEYS[2])
+`
+
+// renewScript extends the leadership if it is still owned by the claim.
+//
+// KEYS[1] leader key, ARGV[1] claim id, ARGV[2] ttl in millis.
+const renewScript = `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+`
+
+// resignScript gives up the leadership if it is still owned by the claim.
+//
+// KEYS[1] leader key, ARGV[1] claim id.
+const resignScript = `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("DEL", KEYS[1])
+`
+
+// leadership is held by a single compactor replica at a time. Fencing tokens
+// increase with every new leadership, so the writes of a replica that has lost
+// its leadership without noticing can be rejected.
+type leadership struct {
+	claimID string
+	fencing int64
+}
+
+// lead tries to take the leadership. Returns a nil leadership if another
+// replica is the leader. Leadership is renewed till the returned stop function
+// is called, returned context is cancelled if a renewal fails.
+func (c *compactorService) lead(ctx context.Context, redisConn *redis.RedisSession) (context.Context, *leadership, func(), error) {
+	claimID, err := newClaimID()
+	if err != nil {
+		return ctx, nil, nil, err
+	}
+
+	ttl := int64(leaderTTL / time.Millisecond)
+	fencing, err := redigo.Int64(redisConn.Do("EVAL", acquireScript, 2,
+		redisConn.AddPrefix(leaderKey), redisConn.AddPrefix(fencingKey), claimID, ttl))
+	if err != nil || fencing == 0 {
+		return ctx, nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(leaderTTL / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+
+			renewed, err := redigo.Int(redisConn.Do("EVAL", renewScript, 1, redisConn.AddPrefix(leaderKey), claimID, ttl))
+			if err != nil || renewed == 0 {
+				c.app.ErrorLog("msg", "lost the compactor leadership", "err", err)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		close(done)
+		cancel()
+		if _, err := redisConn.Do("EVAL", resignScript, 1, redisConn.AddPrefix(leaderKey), claimID); err != nil {
+			c.app.ErrorLog("msg", "error while giving up the compactor leadership", "err", err.Error())
+		}
+	}
+
+	return ctx, &leadership{claimID: claimID, fencing: fencing}, stop, nil
+}
@@ -0,0 +1,196 @@
+package compactor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"os"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/koding/redis"
+)
+
+// leaseDur is how long a claimed member is kept in the processing set before
+// the reaper puts it back to its queue.
+const leaseDur = 5 * time.Minute
+
+// recoveredMembers counts the members that are put back to their queues after
+// their leases have expired.
+var recoveredMembers = expvar.NewInt("compactor_recovered_members")
+
+// claimScript moves the member into the processing set and records its lease.
+//
+// KEYS[1] queue, KEYS[2] processing set, KEYS[3] lease deadlines, KEYS[4] lease
+// owners, ARGV[1] member, ARGV[2] claim id, ARGV[3] deadline in unix millis.
+const claimScript = `
+if redis.call("SMOVE", KEYS[1], KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
+redis.call("HSET", KEYS[4], ARGV[1], ARGV[2])
+return 1
+`
+
+// claimBatchScript pops up to the given number of members from the queue,
+// moves them into the processing set and records their leases.
+//
+// KEYS are the same with claimScript, ARGV[1] count, ARGV[2] claim id,
+// ARGV[3] deadline in unix millis.
+const claimBatchScript = `
+redis.replicate_commands()
+local members = redis.call("SPOP", KEYS[1], ARGV[1])
+for _, member in ipairs(members) do
+	redis.call("SADD", KEYS[2], member)
+	redis.call("ZADD", KEYS[3], ARGV[3], member)
+	redis.call("HSET", KEYS[4], member, ARGV[2])
+end
+return members
+`
+
+// releaseScript removes the members from the processing set, or moves them
+// back to the queue, if their leases are still owned by the given claim.
+// Returns the number of the released members.
+//
+// KEYS are the same with claimScript, ARGV[1] claim id, ARGV[2] "1" to move
+// the members back to the queue, ARGV[3...] members.
+const releaseScript = `
+local released = 0
+for i = 3, #ARGV do
+	local member = ARGV[i]
+	if redis.call("HGET", KEYS[4], member) == ARGV[1] then
+		redis.call("ZREM", KEYS[3], member)
+		redis.call("HDEL", KEYS[4], member)
+		if ARGV[2] == "1" then
+			released = released + redis.call("SMOVE", KEYS[2], KEYS[1], member)
+		else
+			released = released + redis.call("SREM", KEYS[2], member)
+		end
+	end
+end
+return released
+`
+
+// reapScript moves the members with the expired leases, and the ones without
+// any lease, from the processing set back to the queue. Returns the number of
+// the moved members.
+//
+// KEYS are the same with claimScript, ARGV[1] now in unix millis.
+const reapScript = `
+local moved = 0
+for _, member in ipairs(redis.call("ZRANGEBYSCORE", KEYS[3], "-inf", ARGV[1])) do
+	moved = moved + redis.call("SMOVE", KEYS[2], KEYS[1], member)
+	redis.call("ZREM", KEYS[3], member)
+	redis.call("HDEL", KEYS[4], member)
+end
+for _, member in ipairs(redis.call("SMEMBERS", KEYS[2])) do
+	if redis.call("HEXISTS", KEYS[4], member) == 0 then
+		moved = moved + redis.call("SMOVE", KEYS[2], KEYS[1], member)
+	end
+end
+return moved
+`
+
+// owner identifies this compactor process in the lease claims.
+var owner = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}()
+
+// leaseKeys returns the keys of the lease scripts for the given queue.
+func leaseKeys(redisConn *redis.RedisSession, queueName string) []interface{} {
+	return []interface{}{
+		4,
+		redisConn.AddPrefix(queueName),
+		redisConn.AddPrefix(queueName + "_processing"),
+		redisConn.AddPrefix(queueName + "_leases"),
+		redisConn.AddPrefix(queueName + "_owners"),
+	}
+}
+
+// claim moves the member into the processing set with a lease. Returns an
+// empty claim id if the member is not in the queue anymore.
+func claim(redisConn *redis.RedisSession, queueName, member string, now time.Time) (string, error) {
+	claimID, err := newClaimID()
+	if err != nil {
+		return "", err
+	}
+
+	args := append([]interface{}{claimScript}, leaseKeys(redisConn, queueName)...)
+	res, err := redigo.Int(redisConn.Do("EVAL", append(args, member, claimID, leaseDeadline(now))...))
+	if err != nil || res == 0 {
+		return "", err
+	}
+	return claimID, nil
+}
+
+// claimBatch moves up to count members of the queue into the processing set
+// with a lease.
+func claimBatch(redisConn *redis.RedisSession, queueName string, count int, now time.Time) ([]string, string, error) {
+	claimID, err := newClaimID()
+	if err != nil {
+		return nil, "", err
+	}
+
+	args := append([]interface{}{claimBatchScript}, leaseKeys(redisConn, queueName)...)
+	members, err := redigo.Strings(redisConn.Do("EVAL", append(args, count, claimID, leaseDeadline(now))...))
+	if err != nil {
+		return nil, "", err
+	}
+	return members, claimID, nil
+}
+
+// release ends the leases of the claim. Members are moved back to the queue if
+// requeue is set, otherwise they are removed from the processing set. Returns
+// the number of the released members, the ones with the expired leases might
+// have been taken over.
+func release(redisConn *redis.RedisSession, queueName, claimID string, requeue bool, members ...string) (int, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+
+	flag := "0"
+	if requeue {
+		flag = "1"
+	}
+
+	args := append([]interface{}{releaseScript}, leaseKeys(redisConn, queueName)...)
+	args = append(args, claimID, flag)
+	for _, member := range members {
+		args = append(args, member)
+	}
+	return redigo.Int(redisConn.Do("EVAL", args...))
+}
+
+func newClaimID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return owner + ":" + hex.EncodeToString(b[:]), nil
+}
+
+// leaseDeadline returns the lease deadline in unix millis.
+func leaseDeadline(now time.Time) int64 {
+	return now.Add(leaseDur).UnixNano() / int64(time.Millisecond)
+}
+
+// reap moves the members with the expired leases back to the queue.
+func (c *compactorService) reap(redisConn *redis.RedisSession, queueName string, now time.Time) error {
+	args := append([]interface{}{reapScript}, leaseKeys(redisConn, queueName)...)
+	moved, err := redigo.Int(redisConn.Do("EVAL", append(args, now.UnixNano()/int64(time.Millisecond))...))
+	if err != nil {
+		return err
+	}
+
+	if moved != 0 {
+		recoveredMembers.Add(int64(moved))
+		c.app.WarnLog("msg", "recovered members with expired leases", "queue", queueName, "recovered", moved)
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/ropelive/count/pkg/mongodb"
 )
 
 // Middleware describes a service (as opposed to endpoint) middleware.
@@ -25,9 +26,65 @@ type loggingMiddleware struct {
 	logger log.Logger
 }
 
-func (mw loggingMiddleware) Process(ctx context.Context, req ProcessRequest) (err error) {
+func (mw loggingMiddleware) Process(ctx context.Context, req ProcessRequest) (res *ProcessResult, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "Process", "took", time.Since(begin), "err", err)
+		mw.logger.Log("method", "Process", "from", req.From, "to", req.To, "direction", req.Direction, "member", req.Member, "dryRun", req.DryRun, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	return mw.next.Process(ctx, req)
 }
+
+func (mw loggingMiddleware) Rollup(ctx context.Context, req RollupRequest) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "Rollup", "from", req.From, "to", req.To, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.Rollup(ctx, req)
+}
+
+func (mw loggingMiddleware) Checkpoints(ctx context.Context) (checkpoints []CheckpointStatus, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "Checkpoints", "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.Checkpoints(ctx)
+}
+
+func (mw loggingMiddleware) SubmitJob(ctx context.Context, req ProcessRequest) (job *mongodb.Job, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "SubmitJob", "from", req.From, "to", req.To, "direction", req.Direction, "member", req.Member, "dryRun", req.DryRun, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.SubmitJob(ctx, req)
+}
+
+func (mw loggingMiddleware) GetJob(ctx context.Context, id string) (job *mongodb.Job, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetJob", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetJob(ctx, id)
+}
+
+func (mw loggingMiddleware) CancelJob(ctx context.Context, id string) (job *mongodb.Job, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "CancelJob", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.CancelJob(ctx, id)
+}
+
+func (mw loggingMiddleware) DeadLetters(ctx context.Context) (letters []DeadLetter, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "DeadLetters", "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.DeadLetters(ctx)
+}
+
+func (mw loggingMiddleware) RetryDeadLetter(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "RetryDeadLetter", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.RetryDeadLetter(ctx, id)
+}
+
+func (mw loggingMiddleware) DiscardDeadLetter(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "DiscardDeadLetter", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.DiscardDeadLetter(ctx, id)
+}
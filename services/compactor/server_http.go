@@ -1,6 +1,7 @@
 package compactor
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/go-kit/kit/log"
@@ -19,6 +20,7 @@ func MakeHTTPHandler(s Service, logger log.Logger) http.Handler {
 	}
 	r.Methods("GET", "POST").Path("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 	r.Methods("GET", "POST").Path("/healthz").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	r.Methods("GET").Path("/debug/vars").Handler(expvar.Handler())
 
 	r.Methods("POST").Path("/process").Handler(httptransport.NewServer(
 		MakeProcessEndpoint(s),
@@ -27,5 +29,61 @@ func MakeHTTPHandler(s Service, logger log.Logger) http.Handler {
 		options...,
 	))
 
+	r.Methods("POST").Path("/rollup").Handler(httptransport.NewServer(
+		MakeRollupEndpoint(s),
+		decodeRollupRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/checkpoints").Handler(httptransport.NewServer(
+		MakeCheckpointsEndpoint(s),
+		decodeCheckpointsRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/jobs").Handler(httptransport.NewServer(
+		MakeSubmitJobEndpoint(s),
+		decodeProcessRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/jobs/{id}").Handler(httptransport.NewServer(
+		MakeGetJobEndpoint(s),
+		decodeJobRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("DELETE").Path("/jobs/{id}").Handler(httptransport.NewServer(
+		MakeCancelJobEndpoint(s),
+		decodeJobRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/deadletters").Handler(httptransport.NewServer(
+		MakeDeadLettersEndpoint(s),
+		decodeDeadLettersRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/deadletters/{id}/retry").Handler(httptransport.NewServer(
+		MakeRetryDeadLetterEndpoint(s),
+		decodeDeadLetterRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("DELETE").Path("/deadletters/{id}").Handler(httptransport.NewServer(
+		MakeDiscardDeadLetterEndpoint(s),
+		decodeDeadLetterRequest,
+		encodeResponse,
+		options...,
+	))
+
 	return r
 }
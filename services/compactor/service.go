@@ -2,163 +2,642 @@ package compactor
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	redigo "github.com/garyburd/redigo/redis"
 	"github.com/koding/redis"
 	"github.com/ropelive/count/pkg"
 	"github.com/ropelive/count/pkg/mongodb"
+	mgo "gopkg.in/mgo.v2"
 )
 
 // Service is a simple interface for compactor operations.
 type Service interface {
-	Process(ctx context.Context, p ProcessRequest) error
+	Process(ctx context.Context, p ProcessRequest) (*ProcessResult, error)
+	Rollup(ctx context.Context, p RollupRequest) error
+	Checkpoints(ctx context.Context) ([]CheckpointStatus, error)
+	SubmitJob(ctx context.Context, p ProcessRequest) (*mongodb.Job, error)
+	GetJob(ctx context.Context, id string) (*mongodb.Job, error)
+	CancelJob(ctx context.Context, id string) (*mongodb.Job, error)
+	DeadLetters(ctx context.Context) ([]DeadLetter, error)
+	RetryDeadLetter(ctx context.Context, id string) error
+	DiscardDeadLetter(ctx context.Context, id string) error
 }
 
 type compactorService struct {
 	app *pkg.App
+
+	// jobs holds the cancel functions of the jobs that are run by this
+	// compactor by their ids.
+	jobs sync.Map
+
+	// prepared holds the tenants whose collections are migrated and indexed
+	// by this compactor.
+	prepared sync.Map
 }
 
 // NewService creates a Compator service
 func NewService(app *pkg.App) Service {
+	// redis session is shared by the concurrent runs and requests, so its
+	// prefix is set only once.
+	app.MustGetRedis().SetPrefix("ropecount")
+
 	return &compactorService{
 		app: app,
 	}
 }
 
-// Process
-func (c *compactorService) Process(ctx context.Context, p ProcessRequest) error {
+// Process compacts the segments in the requested range. Range defaults to the
+// configured lookback before the last processible segment of StartAt, and it
+// is extended back to the checkpoint if the compactor is behind. A dry run only
+// reports the merges that would be done. Statistics of the run are returned
+// with the error too.
+func (c *compactorService) Process(ctx context.Context, p ProcessRequest) (*ProcessResult, error) {
+	stats := newRunStats(&ProcessResult{})
+	err := c.run(ctx, p, stats)
+	if err == errNotLeader {
+		err = nil
+	}
+	return stats.res, err
+}
+
+// run processes the request and collects its statistics.
+func (c *compactorService) run(ctx context.Context, p ProcessRequest, stats *runStats) error {
 	c.app.Logger.Log("starttime", p.StartAt.Format(time.RFC3339))
+	defer stats.finish()
 
-	tr := pkg.GetLastProcessibleSegment(p.StartAt)
-	tl := tr.Add(-time.Hour) // / process till this time
+	if p.Direction != "" && p.Direction != pkg.DirectionSrc && p.Direction != pkg.DirectionDst {
+		return errInvalidDirection
+	}
 
 	redisConn := c.app.MustGetRedis()
-	redisConn.SetPrefix("ropecount")
 
-	for tl.UnixNano() <= tr.UnixNano() {
-		c.app.InfoLog("time", tr.Format(time.RFC3339))
+	// only the runs that process every member of the default range move the
+	// checkpoints, explicit ranges might leave gaps behind them. These runs are
+	// done by a single replica, the leader.
+	resume := p.From.IsZero() && p.To.IsZero() && p.Member == ""
+
+	var lead *leadership
+	if resume && !p.DryRun {
+		var stop func()
+		var err error
+		ctx, lead, stop, err = c.lead(ctx, redisConn)
+		if err != nil {
+			return err
+		}
+
+		if lead == nil {
+			c.app.InfoLog("msg", "another compactor is the leader, skipping the run")
+			return errNotLeader
+		}
+		defer stop()
+
+		c.abandonJobs()
+	}
+
+	var checkpoint time.Time
+	if resume {
+		var err error
+		if checkpoint, err = c.oldestCheckpoint(directions(p.Direction)); err != nil {
+			return err
+		}
+	}
+
+	from, to, err := c.segmentRange(p, time.Now().UTC(), checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tenants, err := c.tenants(redisConn)
+	if err != nil {
+		return err
+	}
+
+	// dry runs do not change anything in mongo, migrations and indexes
+	// included.
+	if !p.DryRun {
+		if err := c.prepareTenants(tenants); err != nil {
+			return err
+		}
+	}
+
+	total := int(to.Sub(from)/pkg.SegmentDur) + 1
+
+	// segments are processed in chunks of as many segments as the workers, so
+	// the checkpoints move forward while catching up.
+	chunk := pkg.SegmentDur * time.Duration(c.app.Concurrency()-1)
+	for chunkFrom := from; !chunkFrom.After(to); {
+		chunkTo := chunkFrom.Add(chunk)
+		if chunkTo.After(to) {
+			chunkTo = to
+		}
+
+		var jobs []queueJob
+		var segments int
+		for tr := chunkFrom; !tr.After(chunkTo); tr = tr.Add(pkg.SegmentDur) {
+			c.app.InfoLog("time", tr.Format(time.RFC3339))
+			segments++
+
+			for _, tenant := range tenants {
+				for _, keyNames := range queues(pkg.GenerateKeyNames(tenant, tr), p.Direction) {
+					jobs = append(jobs, queueJob{segment: tr, keyNames: keyNames})
+				}
+			}
+		}
+
+		chunkFrom = chunkTo.Add(pkg.SegmentDur)
+
+		if p.DryRun {
+			merges, err := c.dryRun(ctx, redisConn, jobs, p.Member)
+			if err != nil {
+				return err
+			}
+			stats.planned(merges)
+		} else {
+			for _, job := range jobs {
+				if err := c.reap(redisConn, job.keyNames.CurrentCounterSet, time.Now()); err != nil {
+					return err
+				}
+			}
+
+			if err := c.processQueues(ctx, redisConn, jobs, p.Member, stats); err != nil {
+				return err
+			}
+
+			if resume {
+				for _, dir := range directions(p.Direction) {
+					if err := mongodb.SetCheckpoint(c.app.MustGetMongo(), dir, chunkTo, lead.fencing); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		stats.visited(segments, total)
+
+		oldest, err := oldestSegment(redisConn, jobs)
+		if err != nil {
+			return err
+		}
+		stats.pending(oldest)
+	}
+
+	if p.DryRun {
+		return nil
+	}
+
+	if err := c.rollupTouches(ctx, stats.touches()); err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		if err := c.expire(tenant, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// oldestCheckpoint returns the oldest checkpoint of the given directions. Zero
+// time is returned if any of them does not have a checkpoint yet.
+func (c *compactorService) oldestCheckpoint(dirs []string) (time.Time, error) {
+	var oldest time.Time
+	for _, dir := range dirs {
+		cp, err := mongodb.GetCheckpoint(c.app.MustGetMongo(), dir)
+		if err == mgo.ErrNotFound {
+			return time.Time{}, nil
+		}
+
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if oldest.IsZero() || cp.Segment.Before(oldest) {
+			oldest = cp.Segment
+		}
+	}
+	return oldest, nil
+}
+
+// Checkpoints returns the checkpoints of the directions and how far they are
+// behind the last processible segment.
+func (c *compactorService) Checkpoints(ctx context.Context) ([]CheckpointStatus, error) {
+	last := pkg.GetLastProcessibleSegment(time.Now().UTC())
+
+	var res []CheckpointStatus
+	for _, dir := range directions("") {
+		cp, err := mongodb.GetCheckpoint(c.app.MustGetMongo(), dir)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, CheckpointStatus{
+			Checkpoint: *cp,
+			Lag:        last.Sub(cp.Segment),
+		})
+	}
+	return res, nil
+}
+
+// expire deletes the compaction documents of the tenant that are older than
+// their retentions.
+func (c *compactorService) expire(tenant string, now time.Time) error {
+	mongo := c.app.MustGetMongo()
+	for key, retention := range c.app.Retention() {
+		if retention == 0 {
+			continue
+		}
+
+		collection := mongodb.CompactionCollection(tenant)
+		if key != pkg.RetentionSegments {
+			collection = mongodb.RollupCollection(tenant, mongodb.Granularity(key))
+		}
+
+		removed, err := mongodb.ExpireCompactions(mongo, collection, now.Add(-retention))
+		if err != nil {
+			return err
+		}
+
+		if removed != 0 {
+			c.app.InfoLog("msg", "expired compactions", "collection", collection, "removed", removed)
+		}
+	}
+	return nil
+}
+
+var errInvalidDirection = errors.New("direction should be src or dst")
+
+// errNotLeader is returned by the runs without a range when another compactor
+// is the leader, they are skipped.
+var errNotLeader = errors.New("another compactor is the leader")
+
+// segmentRange returns the first and the last segments to process. The
+// segments that can still be written to are never processed. Default range
+// starts from the segment after the given checkpoint if it is older.
+func (c *compactorService) segmentRange(p ProcessRequest, now, checkpoint time.Time) (from, to time.Time, err error) {
+	last := pkg.GetLastProcessibleSegment(now)
+
+	switch {
+	case !p.To.IsZero():
+		to = pkg.GetSegment(p.To)
+	case !p.StartAt.IsZero():
+		to = pkg.GetLastProcessibleSegment(p.StartAt)
+	default:
+		to = last
+	}
+
+	if to.After(last) {
+		to = last
+	}
+
+	from = to.Add(-c.app.Lookback())
+	if !p.From.IsZero() {
+		from = pkg.GetSegment(p.From)
+	} else if next := checkpoint.Add(pkg.SegmentDur); !checkpoint.IsZero() && next.Before(from) {
+		from = next
+	}
+
+	if to.Before(from) {
+		return from, to, errInvalidRange
+	}
+
+	return from, to, nil
+}
+
+// directions returns the given direction, both of them if it is empty.
+func directions(direction string) []string {
+	if direction != "" {
+		return []string{direction}
+	}
+	return []string{pkg.DirectionSrc, pkg.DirectionDst}
+}
+
+// queues returns the queues of the given direction, both of them if it is
+// empty.
+func queues(keyNames *pkg.AllKeys, direction string) []pkg.KeyNames {
+	switch direction {
+	case pkg.DirectionSrc:
+		return []pkg.KeyNames{keyNames.Src}
+	case pkg.DirectionDst:
+		return []pkg.KeyNames{keyNames.Dst}
+	default:
+		return []pkg.KeyNames{keyNames.Src, keyNames.Dst}
+	}
+}
+
+// Rollup re-computes the hourly, daily and monthly rollups of the windows in
+// the given range, except the ones with the expired sources.
+func (c *compactorService) Rollup(ctx context.Context, p RollupRequest) error {
+	if p.To.IsZero() {
+		p.To = p.From
+	}
+
+	if p.From.IsZero() || p.To.Before(p.From) {
+		return errInvalidRange
+	}
+
+	if p.To.Sub(p.From) > maxRollupRange {
+		return errRangeTooLong
+	}
+
+	redisConn := c.app.MustGetRedis()
+
+	tenants, err := c.tenants(redisConn)
+	if err != nil {
+		return err
+	}
+
+	if err := c.prepareTenants(tenants); err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		if err := c.rollup(ctx, tenant, p.From, p.To); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// maxRollupRange caps the range of a rollup request, every window of every
+// granularity in the range is re-computed.
+const maxRollupRange = 31 * 24 * time.Hour
+
+var (
+	errInvalidRange = errors.New("range should have a start and its end should not be before its start")
+	errRangeTooLong = fmt.Errorf("range should not be longer than %s", maxRollupRange)
+)
 
-		keyNames := pkg.GenerateKeyNames(tr)
-		for {
-			var srcErr, dstErr error
+// rollup rolls up the windows of every granularity that hold the segments in
+// the given range. Finer granularities are rolled up first, as they are the
+// sources of the coarser ones.
+func (c *compactorService) rollup(ctx context.Context, tenant string, from, to time.Time) error {
+	mongo := c.app.MustGetMongo()
+	now := time.Now().UTC()
+	for _, g := range mongodb.Granularities {
+		w := g.Window(from)
+		if start := c.rollupStart(g, now); w.Before(start) {
+			c.app.InfoLog("msg", "skipping the rollups with the expired sources", "granularity", g, "from", w, "till", start)
+			w = start
+		}
+
+		for ; !w.After(to); w = g.Next(w) {
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
 			default:
-				srcErr = c.process(redisConn, keyNames.Src, tr)
-				dstErr = c.process(redisConn, keyNames.Dst, tr)
 			}
-			if srcErr == dstErr && srcErr == errNotFound {
-				break
+
+			if err := mongodb.Rollup(mongo, tenant, g, w, nil); err != nil {
+				return err
 			}
-			if srcErr != nil && srcErr != errNotFound {
-				return srcErr
+		}
+	}
+	return nil
+}
+
+// rollupTouches rolls up the windows that hold the given compaction documents,
+// only for the users of the documents. Finer granularities are rolled up
+// first, as they are the sources of the coarser ones.
+func (c *compactorService) rollupTouches(ctx context.Context, touches []touch) error {
+	mongo := c.app.MustGetMongo()
+	now := time.Now().UTC()
+	for _, g := range mongodb.Granularities {
+		start := c.rollupStart(g, now)
+
+		type window struct {
+			tenant string
+			start  time.Time
+		}
+		users := make(map[window][]string)
+		var windows []window
+		for _, t := range touches {
+			w := window{tenant: t.tenant, start: g.Window(t.segment)}
+			if w.start.Before(start) {
+				continue
 			}
-			if dstErr != nil && dstErr != errNotFound {
-				return dstErr
+
+			if _, ok := users[w]; !ok {
+				windows = append(windows, w)
 			}
+			users[w] = append(users[w], t.userID)
 		}
 
-		tr = tr.Add(-pkg.SegmentDur)
-	}
+		for _, w := range windows {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
 
+			if err := mongodb.Rollup(mongo, w.tenant, g, w.start, uniqueStrings(users[w])); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-var errNotFound = errors.New("no item to process")
+func uniqueStrings(vals []string) []string {
+	seen := make(map[string]struct{}, len(vals))
+	res := vals[:0]
+	for _, val := range vals {
+		if _, ok := seen[val]; !ok {
+			seen[val] = struct{}{}
+			res = append(res, val)
+		}
+	}
+	return res
+}
+
+// rollupStart returns the start of the oldest window of the granularity that
+// can be rolled up at the given time. Rollups are re-computed from scratch, so
+// a window that might have lost some of its sources to the retention is not
+// rolled up again, its rollup would lose their values.
+func (c *compactorService) rollupStart(g mongodb.Granularity, now time.Time) time.Time {
+	retention := c.app.Retention().SourceRetention(g)
+	if retention == 0 {
+		return time.Time{}
+	}
 
-func (c *compactorService) process(redisConn *redis.RedisSession, keyNames pkg.KeyNames, tr time.Time) error {
-	c.app.InfoLog("current_counter_queue", keyNames.CurrentCounterSet)
-	return c.withLock(redisConn, keyNames.CurrentCounterSet, func(srcMember string) error {
-		source := keyNames.HashSetName(srcMember)
-		return c.merge(redisConn, source)
-	})
+	// the window that holds the oldest kept source might have lost some.
+	return g.Next(now.Add(-retention))
 }
 
-// withLock gets an item from the current segment's item set and  passes it to
-// the given processor function. After getting a response from the processor a successfull
-func (c *compactorService) withLock(redisConn *redis.RedisSession, queueName string, fn func(srcMember string) error) error {
-	srcMember, err := redisConn.RandomSetMember(queueName)
-	if err == redis.ErrNil {
-		return errNotFound // we dont have any, so nothing to do.
+// tenants returns the default tenant and the tenants that have counters.
+func (c *compactorService) tenants(redisConn *redis.RedisSession) ([]string, error) {
+	tenants, err := redigo.Strings(redisConn.GetSetMembers(pkg.TenantsSetName))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	return append([]string{""}, tenants...), nil
+}
+
+// prepareTenants prepares the collections of the tenants for the compactions
+// the first time they are seen.
+func (c *compactorService) prepareTenants(tenants []string) error {
+	for _, tenant := range tenants {
+		if err := c.prepareTenant(tenant); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// prepareTenant migrates the legacy compaction documents of the tenant
+// and builds the unique indexes of its collections once, merging the duplicate
+// compaction documents first.
+func (c *compactorService) prepareTenant(tenant string) error {
+	if _, ok := c.prepared.Load(tenant); ok {
+		return nil
+	}
+
+	mongo := c.app.MustGetMongo()
+	collection := mongodb.CompactionCollection(tenant)
 
+	migrated, err := mongodb.MigrateLegacyCompactions(mongo, collection)
 	if err != nil {
 		return err
 	}
 
-	processingQueueName := queueName + "_processing"
+	if migrated != 0 {
+		c.app.InfoLog("msg", "migrated legacy compaction documents", "tenant", tenant, "migrated", migrated)
+	}
 
-	res, err := redisConn.MoveSetMember(queueName, processingQueueName, srcMember)
+	removed, err := mongodb.EnsureCompactionIndex(mongo, collection)
 	if err != nil {
 		return err
 	}
 
-	// 1 if the element is moved. 0 if the element is not a member of source
-	// and no operation was performed.
-	if res != 1 {
-		c.app.InfoLog("msg", "we tried to move a current member to processing queue but failed, someone has already moved the item in the mean time...")
-		return c.withLock(redisConn, queueName, fn)
+	if removed != 0 {
+		c.app.InfoLog("msg", "merged duplicate compaction documents", "tenant", tenant, "removed", removed)
+	}
+
+	if err := mongodb.EnsureRollupIndexes(mongo, tenant); err != nil {
+		return err
+	}
+
+	c.prepared.Store(tenant, struct{}{})
+	return nil
+}
+
+var errNotFound = errors.New("no item to process")
+
+// processMember processes the given member of the queue if it is in the
+// queue.
+func (c *compactorService) processMember(redisConn *redis.RedisSession, keyNames pkg.KeyNames, member string, stats *runStats) error {
+	return c.withMember(redisConn, keyNames, member, func(srcMember string) error {
+		return c.merge(redisConn, keyNames.HashSetName(srcMember), stats)
+	}, stats)
+}
+
+// withMember claims the given member of the queue and passes it to the given
+// processor function. Returns errNotFound if the member is not in the queue. A
+// member that has failed too many times is dead-lettered without an error.
+func (c *compactorService) withMember(redisConn *redis.RedisSession, keyNames pkg.KeyNames, srcMember string, fn func(srcMember string) error, stats *runStats) error {
+	queueName := keyNames.CurrentCounterSet
+
+	// claim id is empty if the element is not a member of source and no
+	// operation was performed.
+	claimID, err := claim(redisConn, queueName, srcMember, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if claimID == "" {
+		return errNotFound
 	}
 
 	fnErr := fn(srcMember)
 
 	if fnErr != nil {
-		_, err = redisConn.MoveSetMember(processingQueueName, queueName, srcMember)
+		requeued, err := c.fail(redisConn, keyNames, claimID, []string{srcMember}, []error{fnErr}, stats)
 		if err != nil {
 			c.app.ErrorLog("msg", "error while trying to put to item back to process set after an unseccesful operation", "err", err.Error())
 		}
 
+		if err == nil && requeued == 0 {
+			return nil
+		}
 		return fnErr
 	}
 
-	res, err = redisConn.RemoveSetMembers(processingQueueName, srcMember)
-	if err == redis.ErrNil {
-		c.app.ErrorLog("msg", "we should be able to delete from the processing set here, but failed.")
-		return err
-	}
-
+	released, err := release(redisConn, queueName, claimID, false, srcMember)
 	if err != nil {
 		c.app.ErrorLog("msg", err.Error())
 		return err
 	}
 
-	if res == 0 {
-		c.app.ErrorLog("msg", "we should be able to delete from the processing set here, but failed.")
+	if released == 0 {
+		c.app.ErrorLog("msg", "lease of the member has expired before it is processed, it might be processed again.", "member", srcMember)
 	}
 
 	return nil
 }
 
 // merge merges the source hash map values to the target, then deletes the
-// source hash map from the server.
-func (c *compactorService) merge(redisConn *redis.RedisSession, source string) error {
-	fns, err := redigo.Int64Map(redisConn.HashGetAll(source))
-	if err == redis.ErrNil {
-		c.app.ErrorLog("msg", "item was in the queue but the corresponding values does not exist as hash map")
-		return nil
+// source hash map from the server. A random nonce is put into the source before
+// reading it, so a retry of a merge that has crashed after writing to Mongo has
+// the same marker and is not applied twice.
+func (c *compactorService) merge(redisConn *redis.RedisSession, source string, stats *runStats) error {
+	parsedKey, err := parseKeyName(source)
+	if err != nil {
+		return &memberError{err}
 	}
 
+	nonce, err := newNonce()
 	if err != nil {
 		return err
 	}
 
-	if len(fns) == 0 {
+	if _, err := redisConn.HashSetIfNotExists(source, pkg.NonceField, nonce); err != nil {
+		return err
+	}
+
+	reply, err := redisConn.HashGetAll(source)
+	if err == redis.ErrNil {
+		c.app.ErrorLog("msg", "item was in the queue but the corresponding values does not exist as hash map")
 		return nil
 	}
 
-	if err = c.incrementMapValues(source, fns); err != nil {
+	if err != nil {
 		return err
 	}
 
-	res, err := redisConn.Del(source)
-	if err != redis.ErrNil {
-		c.app.Logger.Log("msg", "we should be able to delete the counter here, but failed.", "err", err)
-		return nil
+	fns, err := redigo.Int64Map(reply, nil)
+	if err != nil {
+		return &memberError{err}
 	}
 
+	var written *mongodb.CompactionUpsert
+	if len(fns) > 1 {
+		written, err = c.incrementMapValues(source, fns)
+		if err == mongodb.ErrAlreadyApplied {
+			c.app.InfoLog("msg", "counter hash map is already merged, deleting it", "source", source)
+			written, err = nil, nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := redisConn.Del(source)
 	if err != nil {
 		return err
 	}
@@ -167,22 +646,166 @@ func (c *compactorService) merge(redisConn *redis.RedisSession, source string) e
 		c.app.Logger.Log("msg", "we should be able to delete the counter hash map here, but failed. someone might already have deleted it..")
 	}
 
+	stats.merged(parsedKey.Tenant, parsedKey.Direction, written)
 	return nil
 }
 
-func (c *compactorService) incrementMapValues(source string, fns map[string]int64) error {
-	mongo := c.app.MustGetMongo()
-	parsedKey := pkg.ParseKeyName(source)
+// incrementMapValues adds the values of the counter hash map to its compaction
+// document and returns the written values.
+func (c *compactorService) incrementMapValues(source string, fns map[string]int64) (*mongodb.CompactionUpsert, error) {
+	parsedKey, u, err := compactionUpsert(source, fns)
+	if err != nil {
+		return nil, &memberError{err}
+	}
+
+	err = mongodb.UpsertCompaction(
+		c.app.MustGetMongo(),
+		parsedKey.Tenant,
+		u.UserID,
+		u.Direction,
+		u.Segment,
+		u.Marker,
+		u.Data,
+		u.Series,
+	)
+
+	// mongo has rejected the document itself.
+	switch err.(type) {
+	case *mgo.LastError, *mgo.QueryError:
+		err = &memberError{err}
+	}
+	return u, err
+}
+
+// compactionUpsert prepares the compaction values of the given counter hash
+// map.
+func compactionUpsert(source string, fns map[string]int64) (*pkg.ParsedKeyName, *mongodb.CompactionUpsert, error) {
+	parsedKey, err := parseKeyName(source)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	if parsedKey.Name == "" {
-		return errors.New("name should be set")
+		return nil, nil, errors.New("name should be set")
 	}
 
-	return mongodb.InsertCompaction(
-		mongo,
-		parsedKey.Name,
-		parsedKey.Direction,
-		parsedKey.Segment,
-		fns,
-	)
+	vals := make(map[string]int64, len(fns))
+	for field, val := range fns {
+		if field != pkg.NonceField {
+			vals[field] = val
+		}
+	}
+
+	data, series := funcStats(vals)
+	return parsedKey, &mongodb.CompactionUpsert{
+		UserID:    parsedKey.Name,
+		Direction: parsedKey.Direction,
+		Segment:   parsedKey.Segment,
+		Marker:    mergeMarker(parsedKey, fns),
+		Data:      data,
+		Series:    series,
+	}, nil
+}
+
+// parseKeyName parses the given key like pkg.ParseKeyName, but returns an
+// error instead of panicking for a malformed key.
+func parseKeyName(s string) (pk *pkg.ParsedKeyName, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed key %q: %v", s, r)
+		}
+	}()
+	return pkg.ParseKeyName(s), nil
+}
+
+// newNonce returns a random positive number.
+func newNonce() (int64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:]) >> 1), nil
+}
+
+// mergeMarker generates the idempotency marker of a merge from the segment,
+// direction, member and the content of the counter hash map.
+func mergeMarker(parsedKey *pkg.ParsedKeyName, fns map[string]int64) string {
+	fields := make([]string, 0, len(fns))
+	for field := range fns {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	h := sha1.New()
+	for _, field := range fields {
+		fmt.Fprintf(h, "%s=%d\n", field, fns[field])
+	}
+
+	return fmt.Sprintf("%s:%s:%s:%x", parsedKey.Segment, parsedKey.Direction, parsedKey.Name, h.Sum(nil))
+}
+
+// funcStats groups the raw counter hash values by their function names. Values
+// of the labeled series are returned separately and are added to the totals of
+// their functions.
+func funcStats(fns map[string]int64) (map[string]*mongodb.FuncStats, map[string]*mongodb.Series) {
+	stats := make(map[string]*mongodb.FuncStats)
+	for field, val := range fns {
+		seriesName, metric := pkg.ParseFieldName(field)
+		st, ok := stats[seriesName]
+		if !ok {
+			st = &mongodb.FuncStats{}
+			stats[seriesName] = st
+		}
+
+		switch {
+		case metric == pkg.MetricCalls:
+			st.Calls = val
+		case metric == pkg.MetricMin:
+			st.Min = val
+		case metric == pkg.MetricMax:
+			st.Max = val
+		case strings.HasPrefix(metric, pkg.MetricBucketPrefix):
+			if st.Buckets == nil {
+				st.Buckets = make(map[string]int64)
+			}
+			st.Buckets[strings.TrimPrefix(metric, pkg.MetricBucketPrefix)] = val
+		case strings.HasPrefix(metric, pkg.MetricOutcomePrefix):
+			if st.Outcomes == nil {
+				st.Outcomes = make(map[string]int64)
+			}
+			st.Outcomes[strings.TrimPrefix(metric, pkg.MetricOutcomePrefix)] = val
+		case strings.HasPrefix(metric, pkg.MetricErrorClassPrefix):
+			if st.ErrorClasses == nil {
+				st.ErrorClasses = make(map[string]int64)
+			}
+			st.ErrorClasses[strings.TrimPrefix(metric, pkg.MetricErrorClassPrefix)] = val
+		default:
+			st.Duration = val
+		}
+	}
+
+	data := make(map[string]*mongodb.FuncStats)
+	var series map[string]*mongodb.Series
+	for seriesName, st := range stats {
+		funcName, labels := pkg.ParseSeriesName(seriesName)
+		if _, ok := data[funcName]; !ok {
+			data[funcName] = &mongodb.FuncStats{}
+		}
+		data[funcName].Add(st)
+
+		if labels == nil {
+			continue
+		}
+
+		if series == nil {
+			series = make(map[string]*mongodb.Series)
+		}
+		series[seriesName] = &mongodb.Series{
+			Func:      funcName,
+			Labels:    labels,
+			FuncStats: *st,
+		}
+	}
+
+	return data, series
 }
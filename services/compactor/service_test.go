@@ -2,15 +2,21 @@ package compactor
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"math/rand"
+	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/koding/redis"
 	"github.com/ropelive/count/pkg"
 	"github.com/ropelive/count/pkg/mongodb"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func withApp(fn func(app *pkg.App)) {
@@ -79,7 +85,7 @@ func Test_compactorService_incrementMapValues(t *testing.T) {
 				c := &compactorService{
 					app: tt.fields.app,
 				}
-				if err := c.incrementMapValues(tt.args.source, tt.args.fns); (err != nil) != tt.wantErr {
+				if _, err := c.incrementMapValues(tt.args.source, tt.args.fns); (err != nil) != tt.wantErr {
 					t.Errorf("compactorService.incrementMapValues() error = %v, wantErr %v", err, tt.wantErr)
 				}
 
@@ -88,7 +94,7 @@ func Test_compactorService_incrementMapValues(t *testing.T) {
 				}
 
 				parsedKeys := pkg.ParseKeyName(tt.args.source)
-				fns, err := mongodb.GetCompaction(app.MustGetMongo(), parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment)
+				fns, err := mongodb.GetCompaction(app.MustGetMongo(), parsedKeys.Tenant, parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment)
 				if err != nil {
 					t.Errorf("mongodb.GetCompaction() error = %v", err)
 				}
@@ -98,8 +104,8 @@ func Test_compactorService_incrementMapValues(t *testing.T) {
 				}
 
 				for key, val := range tt.args.fns {
-					if fns[key] != val {
-						t.Errorf(" fns[key] != val | %d != %d", fns[key], val)
+					if fns[key] == nil || fns[key].Duration != val {
+						t.Errorf(" fns[key].Duration != val | %+v != %d", fns[key], val)
 					}
 				}
 
@@ -107,7 +113,7 @@ func Test_compactorService_incrementMapValues(t *testing.T) {
 					t.Errorf("redisConn.Del(tt.args.source) error = %v", err)
 				}
 
-				if err := mongodb.DeleteCompaction(app.MustGetMongo(), parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment); err != nil {
+				if err := mongodb.DeleteCompaction(app.MustGetMongo(), parsedKeys.Tenant, parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment); err != nil {
 					t.Errorf("mongodb.DeleteCompaction() error = %v", err)
 				}
 			})
@@ -138,7 +144,7 @@ func Test_compactorService_merge(t *testing.T) {
 			name    string
 			fields  fields
 			args    args
-			result  map[string]int64
+			result  map[string]mongodb.FuncStats
 			wantErr bool
 		}{
 			{
@@ -154,9 +160,96 @@ func Test_compactorService_merge(t *testing.T) {
 						"key2": 2,
 					},
 				},
-				result: map[string]int64{
-					"key1": 1,
-					"key2": 2,
+				result: map[string]mongodb.FuncStats{
+					"key1": {Duration: 1},
+					"key2": {Duration: 2},
+				},
+				wantErr: false,
+			},
+			{
+				name: "call counts and min max values",
+				fields: fields{
+					app: app,
+				},
+				args: args{
+					redisConn: redisConn,
+					source:    source,
+					sourceVals: map[string]interface{}{
+						"key1":       10,
+						"key1|calls": 3,
+						"key1|min":   2,
+						"key1|max":   5,
+					},
+				},
+				result: map[string]mongodb.FuncStats{
+					"key1": {Calls: 3, Duration: 10, Min: 2, Max: 5},
+				},
+				wantErr: false,
+			},
+			{
+				name: "latency buckets",
+				fields: fields{
+					app: app,
+				},
+				args: args{
+					redisConn: redisConn,
+					source:    source,
+					sourceVals: map[string]interface{}{
+						"key1":            10,
+						"key1|le_1000000": 2,
+						"key1|le_inf":     1,
+					},
+				},
+				result: map[string]mongodb.FuncStats{
+					"key1": {Duration: 10, Buckets: map[string]int64{"1000000": 2, "inf": 1}},
+				},
+				wantErr: false,
+			},
+			{
+				name: "call outcomes",
+				fields: fields{
+					app: app,
+				},
+				args: args{
+					redisConn: redisConn,
+					source:    source,
+					sourceVals: map[string]interface{}{
+						"key1":                  10,
+						"key1|outcome_success":  2,
+						"key1|outcome_error":    1,
+						"key1|errclass_timeout": 1,
+					},
+				},
+				result: map[string]mongodb.FuncStats{
+					"key1": {
+						Duration:     10,
+						Outcomes:     map[string]int64{"success": 2, "error": 1},
+						ErrorClasses: map[string]int64{"timeout": 1},
+					},
+				},
+				wantErr: false,
+			},
+			{
+				name: "labeled series are added to the function totals",
+				fields: fields{
+					app: app,
+				},
+				args: args{
+					redisConn: redisConn,
+					source:    source,
+					sourceVals: map[string]interface{}{
+						"key1{region=eu}":       10,
+						"key1{region=eu}|calls": 2,
+						"key1{region=eu}|min":   4,
+						"key1{region=eu}|max":   6,
+						"key1{region=us}":       3,
+						"key1{region=us}|calls": 1,
+						"key1{region=us}|min":   3,
+						"key1{region=us}|max":   3,
+					},
+				},
+				result: map[string]mongodb.FuncStats{
+					"key1": {Calls: 3, Duration: 13, Min: 3, Max: 6},
 				},
 				wantErr: false,
 			},
@@ -172,12 +265,12 @@ func Test_compactorService_merge(t *testing.T) {
 					t.Errorf("redisConn.HashMultipleSet(tt.args.source, tt.args.sourceVals) error = %v, wantErr %v", err, tt.wantErr)
 				}
 
-				if err := c.merge(tt.args.redisConn, tt.args.source); (err != nil) != tt.wantErr {
+				if err := c.merge(tt.args.redisConn, tt.args.source, nil); (err != nil) != tt.wantErr {
 					t.Errorf("compactorService.merge() error = %v, wantErr %v", err, tt.wantErr)
 				}
 
 				parsedKeys := pkg.ParseKeyName(tt.args.source)
-				fns, err := mongodb.GetCompaction(app.MustGetMongo(), parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment)
+				fns, err := mongodb.GetCompaction(app.MustGetMongo(), parsedKeys.Tenant, parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment)
 				if err != nil {
 					t.Errorf("mongodb.GetCompaction() error = %v", err)
 				}
@@ -187,8 +280,8 @@ func Test_compactorService_merge(t *testing.T) {
 				}
 
 				for key, val := range tt.result {
-					if fns[key] != val {
-						t.Errorf(" fns[key] != val | %d != %d", fns[key], val)
+					if fns[key] == nil || !reflect.DeepEqual(*fns[key], val) {
+						t.Errorf(" fns[key] != val | %+v != %+v", fns[key], val)
 					}
 				}
 
@@ -196,7 +289,7 @@ func Test_compactorService_merge(t *testing.T) {
 					t.Errorf("redisConn.Del(tt.args.source) error = %v", err)
 				}
 
-				if err := mongodb.DeleteCompaction(app.MustGetMongo(), parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment); err != nil {
+				if err := mongodb.DeleteCompaction(app.MustGetMongo(), parsedKeys.Tenant, parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment); err != nil {
 					t.Errorf("mongodb.DeleteCompaction() error = %v", err)
 				}
 			})
@@ -204,7 +297,73 @@ func Test_compactorService_merge(t *testing.T) {
 	})
 }
 
-func Test_compactorService_withLock(t *testing.T) {
+func Test_compactorService_incrementMapValues_exactlyOnce(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		c := &compactorService{
+			app: app,
+		}
+
+		source := "hset:counter:src:1488868202:cihangir"
+		fns := map[string]int64{
+			"pkg.key1":       10,
+			"pkg.key1|calls": 2,
+			"pkg.key1|min":   4,
+			"pkg.key1|max":   6,
+		}
+
+		if _, err := c.incrementMapValues(source, fns); err != nil {
+			t.Fatalf("compactorService.incrementMapValues() error = %v", err)
+		}
+
+		// same content should not be applied twice.
+		if _, err := c.incrementMapValues(source, fns); err != mongodb.ErrAlreadyApplied {
+			t.Fatalf("compactorService.incrementMapValues() error = %v, want %v", err, mongodb.ErrAlreadyApplied)
+		}
+
+		// merging the segment again with a new nonce should add up to a single
+		// document.
+		fns[pkg.NonceField] = 42
+		if _, err := c.incrementMapValues(source, fns); err != nil {
+			t.Fatalf("compactorService.incrementMapValues() error = %v", err)
+		}
+
+		parsedKeys := pkg.ParseKeyName(source)
+		res, err := mongodb.GetCompaction(app.MustGetMongo(), parsedKeys.Tenant, parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment)
+		if err != nil {
+			t.Errorf("mongodb.GetCompaction() error = %v", err)
+		}
+
+		want := mongodb.FuncStats{Calls: 4, Duration: 20, Min: 4, Max: 6}
+		if res["pkg.key1"] == nil || !reflect.DeepEqual(*res["pkg.key1"], want) {
+			t.Errorf("res[pkg.key1] != want | %+v != %+v", res["pkg.key1"], want)
+		}
+
+		if err := mongodb.DeleteCompaction(app.MustGetMongo(), parsedKeys.Tenant, parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment); err != nil {
+			t.Errorf("mongodb.DeleteCompaction() error = %v", err)
+		}
+	})
+}
+
+func Test_mergeMarker(t *testing.T) {
+	parsedKey := pkg.ParseKeyName("hset:counter:src:1488868200:cihangir")
+	fns := map[string]int64{"key1": 1, "key1|calls": 1}
+
+	marker := mergeMarker(parsedKey, fns)
+	if !strings.HasPrefix(marker, "1488868200:src:cihangir:") {
+		t.Errorf("mergeMarker() = %v, want segment, direction and member prefix", marker)
+	}
+
+	if m := mergeMarker(parsedKey, map[string]int64{"key1|calls": 1, "key1": 1}); m != marker {
+		t.Errorf("mergeMarker() = %v, want %v", m, marker)
+	}
+
+	fns[pkg.NonceField] = 1
+	if m := mergeMarker(parsedKey, fns); m == marker {
+		t.Errorf("mergeMarker() should change with the content")
+	}
+}
+
+func Test_compactorService_withMember(t *testing.T) {
 	withApp(func(app *pkg.App) {
 		var redisConn *redis.RedisSession
 		{
@@ -340,8 +499,10 @@ func Test_compactorService_withLock(t *testing.T) {
 				if tt.beforeOp != nil {
 					tt.beforeOp()
 				}
-				if err := c.withLock(tt.args.redisConn, tt.args.queueName, tt.args.fn); (err != nil) != tt.wantErr {
-					t.Errorf("compactorService.withLock() error = %v, wantErr %v", err, tt.wantErr)
+				keyNames := pkg.KeyNames{CurrentCounterSet: tt.args.queueName}
+				stats := newRunStats(&ProcessResult{})
+				if err := c.withMember(tt.args.redisConn, keyNames, "val", tt.args.fn, stats); (err != nil) != tt.wantErr {
+					t.Errorf("compactorService.withMember() error = %v, wantErr %v", err, tt.wantErr)
 				}
 				if tt.afterOp != nil {
 					tt.afterOp()
@@ -359,90 +520,6 @@ func Test_compactorService_withLock(t *testing.T) {
 	})
 }
 
-func Test_compactorService_process(t *testing.T) {
-	withApp(func(app *pkg.App) {
-		var redisConn *redis.RedisSession
-		{
-			redisConn = app.MustGetRedis()
-			rand.Seed(time.Now().UnixNano())
-			prefix := strconv.Itoa(rand.Int())
-			redisConn.SetPrefix(prefix)
-		}
-
-		tr := time.Date(2017, time.March, 7, 06, 30, 0, 0, time.UTC)
-		keyNames := pkg.GenerateKeyNames(tr)
-		type fields struct {
-			app *pkg.App
-		}
-		type args struct {
-			redisConn *redis.RedisSession
-			keyNames  pkg.KeyNames
-			tr        time.Time
-		}
-		tests := []struct {
-			name     string
-			fields   fields
-			args     args
-			wantErr  bool
-			beforeOp func()
-			afterOp  func()
-		}{
-			{
-				name: "empty call",
-				fields: fields{
-					app: app,
-				},
-				args: args{
-					redisConn: redisConn,
-					keyNames:  keyNames.Src,
-					tr:        tr, // not important
-				},
-				wantErr: true, // should get no item err
-			},
-			{
-				name: "on multiple items, should only process one of them",
-				fields: fields{
-					app: app,
-				},
-				args: args{
-					redisConn: redisConn,
-					keyNames:  keyNames.Src,
-					tr:        tr,
-				},
-				wantErr: false,
-				beforeOp: func() {
-					queueName := "set:counter:src:1488868200"
-					if _, err := redisConn.AddSetMembers(queueName, "val1", "val2"); err != nil {
-						t.Errorf("redisConn.AddSetMembers(queueName, val) error = %v", err)
-					}
-				},
-				afterOp: func() {
-					queueName := "set:counter:src:1488868200"
-					checkQueueLength(t, redisConn, queueName, 1)
-					queueName += "_processing"
-					checkQueueLength(t, redisConn, queueName, 0)
-				},
-			},
-		}
-		for _, tt := range tests {
-			t.Run(tt.name, func(t *testing.T) {
-				c := &compactorService{
-					app: tt.fields.app,
-				}
-				if tt.beforeOp != nil {
-					tt.beforeOp()
-				}
-				if err := c.process(tt.args.redisConn, tt.args.keyNames, tt.args.tr); (err != nil) != tt.wantErr {
-					t.Errorf("compactorService.process() error = %v, wantErr %v", err, tt.wantErr)
-				}
-				if tt.afterOp != nil {
-					tt.afterOp()
-				}
-			})
-		}
-	})
-}
-
 func checkQueueLength(t *testing.T, redisConn *redis.RedisSession, queueName string, length int) {
 	if members, err := redisConn.GetSetMembers(queueName); err != nil {
 		t.Errorf("redisConn.GetSetMembers(%q) error = %v", queueName, err)
@@ -605,7 +682,7 @@ func Test_compactorService_Process(t *testing.T) {
 				if tt.beforeOp != nil {
 					tt.beforeOp()
 				}
-				if err := c.Process(tt.args.ctx, tt.args.p); (err != nil) != tt.wantErr {
+				if _, err := c.Process(tt.args.ctx, tt.args.p); (err != nil) != tt.wantErr {
 					t.Errorf("compactorService.Process() error = %v, wantErr %v", err, tt.wantErr)
 				}
 				if tt.afterOp != nil {
@@ -615,3 +692,817 @@ func Test_compactorService_Process(t *testing.T) {
 		}
 	})
 }
+
+func Test_compactorService_reap(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		var redisConn *redis.RedisSession
+		{
+			redisConn = app.MustGetRedis()
+			rand.Seed(time.Now().UnixNano())
+			prefix := strconv.Itoa(rand.Int())
+			redisConn.SetPrefix(prefix)
+		}
+
+		c := &compactorService{
+			app: app,
+		}
+
+		queueName := "my_queue"
+		if _, err := redisConn.AddSetMembers(queueName, "val1", "val2"); err != nil {
+			t.Errorf("redisConn.AddSetMembers(queueName) error = %v", err)
+		}
+
+		now := time.Now()
+		for _, member := range []string{"val1", "val2"} {
+			if claimID, err := claim(redisConn, queueName, member, now); err != nil || claimID == "" {
+				t.Errorf("claim(%q) = %q, error = %v", member, claimID, err)
+			}
+		}
+
+		// leases are not expired yet.
+		if err := c.reap(redisConn, queueName, now); err != nil {
+			t.Errorf("compactorService.reap() error = %v", err)
+		}
+		checkQueueLength(t, redisConn, queueName, 0)
+		checkQueueLength(t, redisConn, queueName+"_processing", 2)
+
+		if err := c.reap(redisConn, queueName, now.Add(leaseDur+time.Second)); err != nil {
+			t.Errorf("compactorService.reap() error = %v", err)
+		}
+		checkQueueLength(t, redisConn, queueName, 2)
+		checkQueueLength(t, redisConn, queueName+"_processing", 0)
+
+		if _, err := redisConn.Del(queueName, queueName+"_leases", queueName+"_owners"); err != nil {
+			t.Errorf("redisConn.Del(%q) error = %v", queueName, err)
+		}
+	})
+}
+
+func Test_compactorService_segmentRange(t *testing.T) {
+	c := &compactorService{
+		app: pkg.NewApp("compactor_test"),
+	}
+
+	now := time.Date(2017, time.March, 7, 6, 32, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		p          ProcessRequest
+		checkpoint time.Time
+		wantFrom   time.Time
+		wantTo     time.Time
+		wantErr    bool
+	}{
+		{
+			name:     "default lookback",
+			p:        ProcessRequest{StartAt: now},
+			wantFrom: time.Date(2017, time.March, 7, 5, 20, 0, 0, time.UTC),
+			wantTo:   time.Date(2017, time.March, 7, 6, 20, 0, 0, time.UTC),
+		},
+		{
+			name:       "catch up from the checkpoint",
+			p:          ProcessRequest{StartAt: now},
+			checkpoint: time.Date(2017, time.March, 7, 1, 0, 0, 0, time.UTC),
+			wantFrom:   time.Date(2017, time.March, 7, 1, 5, 0, 0, time.UTC),
+			wantTo:     time.Date(2017, time.March, 7, 6, 20, 0, 0, time.UTC),
+		},
+		{
+			name:       "recent checkpoint does not shorten the lookback",
+			p:          ProcessRequest{StartAt: now},
+			checkpoint: time.Date(2017, time.March, 7, 6, 15, 0, 0, time.UTC),
+			wantFrom:   time.Date(2017, time.March, 7, 5, 20, 0, 0, time.UTC),
+			wantTo:     time.Date(2017, time.March, 7, 6, 20, 0, 0, time.UTC),
+		},
+		{
+			name: "explicit range",
+			p: ProcessRequest{
+				From: time.Date(2017, time.March, 1, 0, 0, 0, 0, time.UTC),
+				To:   time.Date(2017, time.March, 2, 0, 3, 0, 0, time.UTC),
+			},
+			wantFrom: time.Date(2017, time.March, 1, 0, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2017, time.March, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "segments that can be written to are not processed",
+			p: ProcessRequest{
+				From: time.Date(2017, time.March, 7, 6, 0, 0, 0, time.UTC),
+				To:   now,
+			},
+			wantFrom: time.Date(2017, time.March, 7, 6, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2017, time.March, 7, 6, 20, 0, 0, time.UTC),
+		},
+		{
+			name: "inverted range",
+			p: ProcessRequest{
+				From: time.Date(2017, time.March, 2, 0, 0, 0, 0, time.UTC),
+				To:   time.Date(2017, time.March, 1, 0, 0, 0, 0, time.UTC),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := c.segmentRange(tt.p, now, tt.checkpoint)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("compactorService.segmentRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if !from.Equal(tt.wantFrom) || !to.Equal(tt.wantTo) {
+				t.Errorf("compactorService.segmentRange() = %v, %v, want %v, %v", from, to, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func Test_compactorService_Rollup(t *testing.T) {
+	c := &compactorService{
+		app: pkg.NewApp("compactor_test"),
+	}
+
+	from := time.Date(2017, time.March, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		p       RollupRequest
+		wantErr error
+	}{
+		{
+			name:    "without a start",
+			p:       RollupRequest{To: from},
+			wantErr: errInvalidRange,
+		},
+		{
+			name:    "inverted range",
+			p:       RollupRequest{From: from, To: from.Add(-time.Hour)},
+			wantErr: errInvalidRange,
+		},
+		{
+			name:    "too long range",
+			p:       RollupRequest{From: from, To: from.Add(maxRollupRange + time.Hour)},
+			wantErr: errRangeTooLong,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.Rollup(context.Background(), tt.p); err != tt.wantErr {
+				t.Errorf("compactorService.Rollup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_compactorService_rollupStart(t *testing.T) {
+	os.Setenv("RETENTION", "segment=2h")
+	defer os.Unsetenv("RETENTION")
+
+	c := &compactorService{
+		app: pkg.NewApp("compactor_test", pkg.ConfigureRetention()),
+	}
+
+	now := time.Date(2017, time.March, 7, 6, 32, 0, 0, time.UTC)
+	tests := []struct {
+		g    mongodb.Granularity
+		want time.Time
+	}{
+		// segments of 4:30-5:00 are expired already.
+		{g: mongodb.Hour, want: time.Date(2017, time.March, 7, 5, 0, 0, 0, time.UTC)},
+		{g: mongodb.Day, want: time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.g), func(t *testing.T) {
+			if got := c.rollupStart(tt.g, now); !got.Equal(tt.want) {
+				t.Errorf("compactorService.rollupStart() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_compactorService_prepareTenant(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		c := &compactorService{
+			app: app,
+		}
+
+		rand.Seed(time.Now().UnixNano())
+		tenant := "legacy" + strconv.Itoa(rand.Int())
+		collection := mongodb.CompactionCollection(tenant)
+		mongo := app.MustGetMongo()
+
+		// documents of the baseline have only the total durations, and the
+		// same segment of a user might have been inserted more than once.
+		legacy := func(fns bson.M) {
+			err := mongo.Run(collection, func(c *mgo.Collection) error {
+				return c.Insert(bson.M{"user_id": "user1", "direction": pkg.DirectionSrc, "segment": "1488868200", "data": fns})
+			})
+			if err != nil {
+				t.Fatalf("Insert() error = %v", err)
+			}
+		}
+		defer mongo.Run(collection, func(c *mgo.Collection) error {
+			return c.DropCollection()
+		})
+
+		legacy(bson.M{"fn": int64(10), "fn2": int64(3)})
+		legacy(bson.M{"fn": int64(5)})
+		legacy(bson.M{"fn": "NaN"})
+
+		// a value that can not be decoded aborts the migration as is.
+		if err := c.prepareTenant(tenant); err == nil {
+			t.Fatalf("compactorService.prepareTenant() should fail for the invalid value")
+		}
+
+		var count int
+		err := mongo.Run(collection, func(c *mgo.Collection) (err error) {
+			count, err = c.Count()
+			return err
+		})
+		if err != nil || count != 3 {
+			t.Fatalf("Count() = %d, %v, want 3 documents", count, err)
+		}
+
+		err = mongo.Run(collection, func(c *mgo.Collection) error {
+			return c.Remove(bson.M{"data.fn": "NaN"})
+		})
+		if err != nil {
+			t.Fatalf("Remove() error = %v", err)
+		}
+
+		if err := c.prepareTenant(tenant); err != nil {
+			t.Fatalf("compactorService.prepareTenant() error = %v", err)
+		}
+
+		fns, err := mongodb.GetCompaction(mongo, tenant, "user1", pkg.DirectionSrc, "1488868200")
+		if err != nil {
+			t.Fatalf("mongodb.GetCompaction() error = %v", err)
+		}
+
+		want := map[string]*mongodb.FuncStats{
+			"fn":  {Duration: 15},
+			"fn2": {Duration: 3},
+		}
+		if !reflect.DeepEqual(fns, want) {
+			t.Errorf("mongodb.GetCompaction() = %+v, want %+v", fns, want)
+		}
+
+		// migrated documents can be incremented.
+		err = mongodb.UpsertCompaction(mongo, tenant, "user1", pkg.DirectionSrc, "1488868200", "marker1", map[string]*mongodb.FuncStats{
+			"fn": {Calls: 1, Duration: 2, Min: 2, Max: 2},
+		}, nil)
+		if err != nil {
+			t.Fatalf("mongodb.UpsertCompaction() error = %v", err)
+		}
+	})
+}
+
+func Test_compactorService_processQueues(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		var redisConn *redis.RedisSession
+		{
+			redisConn = app.MustGetRedis()
+			rand.Seed(time.Now().UnixNano())
+			prefix := strconv.Itoa(rand.Int())
+			redisConn.SetPrefix(prefix)
+		}
+
+		c := &compactorService{
+			app: app,
+		}
+
+		tr := time.Date(2017, time.March, 7, 06, 30, 0, 0, time.UTC)
+		keyNames := pkg.GenerateKeyNames("", tr)
+		jobs := []queueJob{
+			{segment: tr, keyNames: keyNames.Src},
+			{segment: tr, keyNames: keyNames.Dst},
+		}
+
+		for _, job := range jobs {
+			for i := 0; i < 20; i++ {
+				if _, err := redisConn.AddSetMembers(job.keyNames.CurrentCounterSet, "val"+strconv.Itoa(i)); err != nil {
+					t.Errorf("redisConn.AddSetMembers() error = %v", err)
+				}
+			}
+		}
+
+		res := &ProcessResult{}
+		if err := c.processQueues(context.Background(), redisConn, jobs, "", newRunStats(res)); err != nil {
+			t.Errorf("compactorService.processQueues() error = %v", err)
+		}
+
+		for _, job := range jobs {
+			checkQueueLength(t, redisConn, job.keyNames.CurrentCounterSet, 0)
+			checkQueueLength(t, redisConn, job.keyNames.CurrentCounterSet+"_processing", 0)
+		}
+
+		want := map[string]int{pkg.DirectionSrc: 20, pkg.DirectionDst: 20}
+		if !reflect.DeepEqual(res.Merged, want) {
+			t.Errorf("res.Merged = %v, want %v", res.Merged, want)
+		}
+
+		if oldest, err := oldestSegment(redisConn, jobs); err != nil || !oldest.IsZero() {
+			t.Errorf("oldestSegment() = %v, %v, want zero time", oldest, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := c.processQueues(ctx, redisConn, jobs, "", nil); err != context.Canceled {
+			t.Errorf("compactorService.processQueues() error = %v, want %v", err, context.Canceled)
+		}
+	})
+}
+
+func Test_compactorService_processBatch(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		var redisConn *redis.RedisSession
+		{
+			redisConn = app.MustGetRedis()
+			rand.Seed(time.Now().UnixNano())
+			prefix := strconv.Itoa(rand.Int())
+			redisConn.SetPrefix(prefix)
+		}
+
+		c := &compactorService{
+			app: app,
+		}
+
+		tr := time.Date(2017, time.March, 7, 06, 30, 0, 0, time.UTC)
+		keyNames := pkg.GenerateKeyNames("", tr).Src
+		members := []string{"member1", "member2", "poison"}
+		for _, member := range members {
+			if _, err := redisConn.AddSetMembers(keyNames.CurrentCounterSet, member); err != nil {
+				t.Errorf("redisConn.AddSetMembers() error = %v", err)
+			}
+		}
+
+		for _, member := range members[:2] {
+			vals := map[string]interface{}{"key1": 10, "key1|calls": 2}
+			if err := redisConn.HashMultipleSet(keyNames.HashSetName(member), vals); err != nil {
+				t.Errorf("redisConn.HashMultipleSet() error = %v", err)
+			}
+		}
+
+		if err := redisConn.HashMultipleSet(keyNames.HashSetName("poison"), map[string]interface{}{"key1": "NaN"}); err != nil {
+			t.Errorf("redisConn.HashMultipleSet() error = %v", err)
+		}
+
+		res := &ProcessResult{}
+		if err := c.processBatch(redisConn, keyNames, newRunStats(res)); err == nil {
+			t.Errorf("compactorService.processBatch() should fail for the poison member")
+		}
+
+		wantRes := &ProcessResult{
+			Merged:    map[string]int{pkg.DirectionSrc: 2},
+			Functions: 2,
+			Duration:  20,
+			Requeued:  1,
+		}
+		if !reflect.DeepEqual(res, wantRes) {
+			t.Errorf("res = %+v, want %+v", res, wantRes)
+		}
+
+		// only the failed member should be put back to the queue.
+		checkQueueLength(t, redisConn, keyNames.CurrentCounterSet, 1)
+		checkQueueLength(t, redisConn, keyNames.CurrentCounterSet+"_processing", 0)
+
+		for _, member := range members[:2] {
+			source := keyNames.HashSetName(member)
+			parsedKeys := pkg.ParseKeyName(source)
+			fns, err := mongodb.GetCompaction(app.MustGetMongo(), parsedKeys.Tenant, parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment)
+			if err != nil {
+				t.Errorf("mongodb.GetCompaction() error = %v", err)
+			}
+
+			want := mongodb.FuncStats{Calls: 2, Duration: 10}
+			if fns["key1"] == nil || !reflect.DeepEqual(*fns["key1"], want) {
+				t.Errorf(" fns[key1] != want | %+v != %+v", fns["key1"], want)
+			}
+
+			if err := mongodb.DeleteCompaction(app.MustGetMongo(), parsedKeys.Tenant, parsedKeys.Name, parsedKeys.Direction, parsedKeys.Segment); err != nil {
+				t.Errorf("mongodb.DeleteCompaction() error = %v", err)
+			}
+		}
+
+		if _, err := redisConn.Del(keyNames.CurrentCounterSet, keyNames.HashSetName("poison")); err != nil {
+			t.Errorf("redisConn.Del() error = %v", err)
+		}
+	})
+}
+
+func Test_compactorService_dryRun(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		var redisConn *redis.RedisSession
+		{
+			redisConn = app.MustGetRedis()
+			rand.Seed(time.Now().UnixNano())
+			prefix := strconv.Itoa(rand.Int())
+			redisConn.SetPrefix(prefix)
+		}
+
+		c := &compactorService{
+			app: app,
+		}
+
+		tr := time.Date(2017, time.March, 7, 06, 30, 0, 0, time.UTC)
+		keyNames := pkg.GenerateKeyNames("", tr).Src
+		members := []string{"member1", "poison"}
+		for _, member := range members {
+			if _, err := redisConn.AddSetMembers(keyNames.CurrentCounterSet, member); err != nil {
+				t.Errorf("redisConn.AddSetMembers() error = %v", err)
+			}
+		}
+
+		if err := redisConn.HashMultipleSet(keyNames.HashSetName("member1"), map[string]interface{}{"key1": 10, "key1|calls": 2}); err != nil {
+			t.Errorf("redisConn.HashMultipleSet() error = %v", err)
+		}
+
+		if err := redisConn.HashMultipleSet(keyNames.HashSetName("poison"), map[string]interface{}{"key1": "NaN"}); err != nil {
+			t.Errorf("redisConn.HashMultipleSet() error = %v", err)
+		}
+
+		jobs := []queueJob{{segment: tr, keyNames: keyNames}}
+		merges, err := c.dryRun(context.Background(), redisConn, jobs, "")
+		if err != nil {
+			t.Fatalf("compactorService.dryRun() error = %v", err)
+		}
+
+		if len(merges) != len(members) {
+			t.Fatalf("len(merges) = %d, want %d", len(merges), len(members))
+		}
+
+		for _, merge := range merges {
+			switch merge.Member {
+			case "member1":
+				want := mongodb.FuncStats{Calls: 2, Duration: 10}
+				if merge.Data["key1"] == nil || !reflect.DeepEqual(*merge.Data["key1"], want) {
+					t.Errorf("merge.Data[key1] != want | %+v != %+v", merge.Data["key1"], want)
+				}
+			case "poison":
+				if merge.Err == "" {
+					t.Errorf("merge.Err should be set for the poison member")
+				}
+			}
+		}
+
+		merges, err = c.dryRun(context.Background(), redisConn, jobs, "member1")
+		if err != nil || len(merges) != 1 {
+			t.Errorf("compactorService.dryRun() = %d merges, %v, want 1 merge", len(merges), err)
+		}
+
+		// a claim with an expired lease is reported, a live one is not.
+		if _, err := claim(redisConn, keyNames.CurrentCounterSet, "member1", time.Now().Add(-2*leaseDur)); err != nil {
+			t.Fatalf("claim() error = %v", err)
+		}
+		if _, err := claim(redisConn, keyNames.CurrentCounterSet, "poison", time.Now()); err != nil {
+			t.Fatalf("claim() error = %v", err)
+		}
+
+		merges, err = c.dryRun(context.Background(), redisConn, jobs, "")
+		if err != nil || len(merges) != 1 || merges[0].Member != "member1" || !merges[0].Stranded {
+			t.Errorf("compactorService.dryRun() = %+v, %v, want the stranded member1", merges, err)
+		}
+
+		// claimed members should not be moved back or deleted.
+		checkQueueLength(t, redisConn, keyNames.CurrentCounterSet, 0)
+		checkQueueLength(t, redisConn, keyNames.CurrentCounterSet+"_processing", len(members))
+
+		keys := []interface{}{
+			keyNames.CurrentCounterSet + "_processing",
+			keyNames.CurrentCounterSet + "_leases",
+			keyNames.CurrentCounterSet + "_owners",
+		}
+		for _, member := range members {
+			keys = append(keys, keyNames.HashSetName(member))
+		}
+		if n, err := redisConn.Del(keys...); err != nil || n != len(keys) {
+			t.Errorf("redisConn.Del() = %d, %v, want %d", n, err, len(keys))
+		}
+	})
+}
+
+func Test_compactorService_lead(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		var redisConn *redis.RedisSession
+		{
+			redisConn = app.MustGetRedis()
+			rand.Seed(time.Now().UnixNano())
+			prefix := strconv.Itoa(rand.Int())
+			redisConn.SetPrefix(prefix)
+		}
+
+		c := &compactorService{
+			app: app,
+		}
+
+		_, first, stop, err := c.lead(context.Background(), redisConn)
+		if err != nil || first == nil {
+			t.Fatalf("compactorService.lead() = %v, error = %v", first, err)
+		}
+
+		if _, second, _, err := c.lead(context.Background(), redisConn); err != nil || second != nil {
+			t.Errorf("compactorService.lead() = %v, error = %v, want no leadership", second, err)
+		}
+
+		stop()
+
+		_, third, stop, err := c.lead(context.Background(), redisConn)
+		if err != nil || third == nil {
+			t.Fatalf("compactorService.lead() = %v, error = %v", third, err)
+		}
+		defer stop()
+
+		if third.fencing <= first.fencing {
+			t.Errorf("fencing token %d should be greater than %d", third.fencing, first.fencing)
+		}
+
+		if _, err := redisConn.Del(fencingKey); err != nil {
+			t.Errorf("redisConn.Del(%q) error = %v", fencingKey, err)
+		}
+	})
+}
+
+func Test_runStats_snapshot(t *testing.T) {
+	stats := newRunStats(&ProcessResult{})
+	stats.visited(2, 4)
+	stats.merged("", pkg.DirectionSrc, &mongodb.CompactionUpsert{
+		Data: map[string]*mongodb.FuncStats{"fn": {Calls: 1, Duration: 5}},
+	})
+	stats.pending(time.Date(2017, time.March, 7, 07, 0, 0, 0, time.UTC))
+	stats.pending(time.Date(2017, time.March, 7, 06, 30, 0, 0, time.UTC))
+
+	res := stats.snapshot()
+	if res.Elapsed == 0 {
+		t.Errorf("res.Elapsed should be set while the run is going on")
+	}
+
+	// snapshot should not change with the run.
+	stats.merged("", pkg.DirectionSrc, nil)
+	stats.finish()
+
+	res.Elapsed = 0
+	want := &ProcessResult{
+		Segments:      2,
+		Total:         4,
+		Merged:        map[string]int{pkg.DirectionSrc: 1},
+		Functions:     1,
+		Duration:      5,
+		OldestSegment: time.Date(2017, time.March, 7, 06, 30, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("stats.snapshot() = %+v, want %+v", res, want)
+	}
+
+	if stats.res.Merged[pkg.DirectionSrc] != 2 || stats.res.Elapsed == 0 {
+		t.Errorf("stats.res = %+v, want 2 src merges and the elapsed time", stats.res)
+	}
+}
+
+func Test_runStats_snapshotMerges(t *testing.T) {
+	stats := newRunStats(&ProcessResult{})
+	stats.planned(make([]Merge, maxSnapshotMerges+5))
+
+	res := stats.snapshot()
+	if res.Planned != maxSnapshotMerges+5 || len(res.Merges) != maxSnapshotMerges {
+		t.Errorf("stats.snapshot() = %d planned, %d merges, want %d planned, %d merges", res.Planned, len(res.Merges), maxSnapshotMerges+5, maxSnapshotMerges)
+	}
+
+	if len(stats.res.Merges) != maxSnapshotMerges+5 {
+		t.Errorf("len(stats.res.Merges) = %d, want %d", len(stats.res.Merges), maxSnapshotMerges+5)
+	}
+}
+
+func Test_runStats_touches(t *testing.T) {
+	stats := newRunStats(&ProcessResult{})
+	for _, tenant := range []string{"", "tenant1", ""} {
+		stats.merged(tenant, pkg.DirectionSrc, &mongodb.CompactionUpsert{
+			UserID:  "user1",
+			Segment: "1488868200",
+			Data:    map[string]*mongodb.FuncStats{"fn": {Calls: 1, Duration: 5}},
+		})
+	}
+
+	// already applied merges do not touch any documents.
+	stats.merged("", pkg.DirectionSrc, nil)
+
+	segment := time.Date(2017, time.March, 7, 06, 30, 0, 0, time.UTC)
+	want := map[touch]bool{
+		{tenant: "", userID: "user1", segment: segment}:        true,
+		{tenant: "tenant1", userID: "user1", segment: segment}: true,
+	}
+
+	touches := stats.touches()
+	if len(touches) != len(want) {
+		t.Fatalf("stats.touches() = %+v, want %v", touches, want)
+	}
+	for _, touch := range touches {
+		if !want[touch] {
+			t.Errorf("stats.touches() has an unexpected touch: %+v", touch)
+		}
+	}
+}
+
+func Test_compactorService_jobs(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		c := &compactorService{
+			app: app,
+		}
+
+		// a dry run of a range without any members finishes right away.
+		from := time.Date(2017, time.March, 7, 06, 30, 0, 0, time.UTC)
+		job, err := c.SubmitJob(context.Background(), ProcessRequest{From: from, To: from, DryRun: true})
+		if err != nil {
+			t.Fatalf("compactorService.SubmitJob() error = %v", err)
+		}
+
+		for i := 0; job.Status == mongodb.JobRunning && i < 50; i++ {
+			time.Sleep(100 * time.Millisecond)
+			if job, err = c.GetJob(context.Background(), job.ID.Hex()); err != nil {
+				t.Fatalf("compactorService.GetJob() error = %v", err)
+			}
+		}
+
+		if job.Status != mongodb.JobDone {
+			t.Fatalf("job.Status = %q, want %q", job.Status, mongodb.JobDone)
+		}
+
+		var res ProcessResult
+		if err := json.Unmarshal(job.Result, &res); err != nil || res.Segments != 1 {
+			t.Errorf("job.Result = %s, %v, want 1 segment", job.Result, err)
+		}
+
+		// cancelling a finished job does not change it.
+		if job, err = c.CancelJob(context.Background(), job.ID.Hex()); err != nil || job.Status != mongodb.JobDone {
+			t.Errorf("compactorService.CancelJob() = %+v, %v", job, err)
+		}
+
+		if _, err := c.GetJob(context.Background(), "invalid"); err != mongodb.ErrInvalidJobID {
+			t.Errorf("compactorService.GetJob() error = %v, want %v", err, mongodb.ErrInvalidJobID)
+		}
+
+		if _, err := c.SubmitJob(context.Background(), ProcessRequest{Direction: "up"}); err != errInvalidDirection {
+			t.Errorf("compactorService.SubmitJob() error = %v, want %v", err, errInvalidDirection)
+		}
+
+		// a job without a range fails when another compactor is the leader.
+		_, lead, stop, err := c.lead(context.Background(), app.MustGetRedis())
+		if err != nil || lead == nil {
+			t.Fatalf("compactorService.lead() = %v, error = %v", lead, err)
+		}
+		defer stop()
+
+		if job, err = c.SubmitJob(context.Background(), ProcessRequest{}); err != nil {
+			t.Fatalf("compactorService.SubmitJob() error = %v", err)
+		}
+
+		for i := 0; job.Status == mongodb.JobRunning && i < 50; i++ {
+			time.Sleep(100 * time.Millisecond)
+			if job, err = c.GetJob(context.Background(), job.ID.Hex()); err != nil {
+				t.Fatalf("compactorService.GetJob() error = %v", err)
+			}
+		}
+
+		if job.Status != mongodb.JobFailed || job.Err != errNotLeader.Error() {
+			t.Errorf("job = %+v, want it to fail with %q", job, errNotLeader)
+		}
+	})
+}
+
+func Test_compactorService_deadLetters(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		var redisConn *redis.RedisSession
+		{
+			redisConn = app.MustGetRedis()
+			rand.Seed(time.Now().UnixNano())
+			prefix := strconv.Itoa(rand.Int())
+			redisConn.SetPrefix(prefix)
+		}
+
+		c := &compactorService{
+			app: app,
+		}
+
+		tr := time.Date(2017, time.March, 7, 05, 30, 0, 0, time.UTC)
+		keyNames := pkg.GenerateKeyNames("", tr).Src
+		source := keyNames.HashSetName("poison")
+
+		// poison member fails every time till it is dead-lettered.
+		deadLetter := func() {
+			if _, err := redisConn.AddSetMembers(keyNames.CurrentCounterSet, "poison"); err != nil {
+				t.Fatalf("redisConn.AddSetMembers() error = %v", err)
+			}
+			if err := redisConn.HashMultipleSet(source, map[string]interface{}{"key1": "NaN"}); err != nil {
+				t.Fatalf("redisConn.HashMultipleSet() error = %v", err)
+			}
+
+			res := &ProcessResult{}
+			for i := 1; i < app.MaxFailures(); i++ {
+				if err := c.processBatch(redisConn, keyNames, newRunStats(res)); err == nil {
+					t.Fatalf("compactorService.processBatch() should fail for the poison member")
+				}
+			}
+
+			if err := c.processBatch(redisConn, keyNames, newRunStats(res)); err != nil {
+				t.Fatalf("compactorService.processBatch() error = %v, want the member to be dead-lettered", err)
+			}
+
+			if res.Requeued != app.MaxFailures()-1 || res.DeadLettered != 1 {
+				t.Errorf("res = %+v, want %d requeued and 1 dead-lettered", res, app.MaxFailures()-1)
+			}
+
+			checkQueueLength(t, redisConn, keyNames.CurrentCounterSet, 0)
+			checkQueueLength(t, redisConn, keyNames.CurrentCounterSet+"_processing", 0)
+		}
+
+		deadLetter()
+
+		letters, err := c.DeadLetters(context.Background())
+		if err != nil {
+			t.Fatalf("compactorService.DeadLetters() error = %v", err)
+		}
+
+		id := deadLetterID(keyNames.CurrentCounterSet, "poison")
+		var found bool
+		for _, letter := range letters {
+			if letter.ID == id {
+				found = letter.Source == source && letter.Err != "" && letter.Failures == app.MaxFailures()
+			}
+		}
+		if !found {
+			t.Fatalf("compactorService.DeadLetters() = %+v, want the poison member", letters)
+		}
+
+		// a retry that fails again leaves the member in its queue.
+		if err := c.RetryDeadLetter(context.Background(), id); err == nil {
+			t.Fatalf("compactorService.RetryDeadLetter() should fail for the poison member")
+		}
+		checkQueueLength(t, redisConn, keyNames.CurrentCounterSet, 1)
+
+		if _, err := redisConn.RemoveSetMembers(keyNames.CurrentCounterSet, "poison"); err != nil {
+			t.Fatalf("redisConn.RemoveSetMembers() error = %v", err)
+		}
+		if _, err := redisConn.Do("DEL", redisConn.AddPrefix(keyNames.CurrentCounterSet+"_failures")); err != nil {
+			t.Fatalf("redisConn.Do(DEL) error = %v", err)
+		}
+
+		// a fixed member is merged right away.
+		deadLetter()
+		if err := redisConn.HashMultipleSet(source, map[string]interface{}{"key1": 10}); err != nil {
+			t.Fatalf("redisConn.HashMultipleSet() error = %v", err)
+		}
+
+		if err := c.RetryDeadLetter(context.Background(), id); err != nil {
+			t.Fatalf("compactorService.RetryDeadLetter() error = %v", err)
+		}
+		checkQueueLength(t, redisConn, keyNames.CurrentCounterSet, 0)
+
+		if redisConn.Exists(source) {
+			t.Errorf("counter hash map of the retried member should be merged")
+		}
+
+		deadLetter()
+
+		if err := c.DiscardDeadLetter(context.Background(), id); err != nil {
+			t.Fatalf("compactorService.DiscardDeadLetter() error = %v", err)
+		}
+
+		if redisConn.Exists(source) {
+			t.Errorf("counter hash map of the discarded member should be deleted")
+		}
+
+		if err := c.DiscardDeadLetter(context.Background(), id); err != errDeadLetterNotFound {
+			t.Errorf("compactorService.DiscardDeadLetter() error = %v, want %v", err, errDeadLetterNotFound)
+		}
+	})
+}
+
+func Test_parseKeyName(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "member",
+			key:  "hset:counter:src:1488868200:cihangir",
+			want: "cihangir",
+		},
+		{
+			name:    "member with separators",
+			key:     "hset:counter:src:1488868200:ci:han:gir",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKeyName(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKeyName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err == nil && got.Name != tt.want {
+				t.Errorf("parseKeyName().Name = %q, want %q", got.Name, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package compactor
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/koding/redis"
+	"github.com/ropelive/count/pkg/mongodb"
+)
+
+// runStats collects the statistics of a run from the workers. A nil runStats
+// does not collect anything.
+type runStats struct {
+	begin time.Time
+
+	mu  sync.Mutex
+	res *ProcessResult
+
+	// touched holds the compaction documents that are written in the run,
+	// their rollups are re-computed at the end of the run.
+	touched map[touch]struct{}
+}
+
+// touch identifies a compaction document of a tenant.
+type touch struct {
+	tenant  string
+	userID  string
+	segment time.Time
+}
+
+func newRunStats(res *ProcessResult) *runStats {
+	if res.Merged == nil {
+		res.Merged = make(map[string]int)
+	}
+	return &runStats{begin: time.Now(), res: res}
+}
+
+// visited counts the visited segments of a run that is over the given number
+// of segments.
+func (s *runStats) visited(n, total int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.res.Segments += n
+	s.res.Total = total
+	s.mu.Unlock()
+}
+
+// planned adds the merges of a dry run.
+func (s *runStats) planned(merges []Merge) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.res.Planned += len(merges)
+	s.res.Merges = append(s.res.Merges, merges...)
+	s.mu.Unlock()
+}
+
+// pending records the given segment if it is the oldest one that still has
+// members.
+func (s *runStats) pending(segment time.Time) {
+	if s == nil || segment.IsZero() {
+		return
+	}
+
+	s.mu.Lock()
+	if s.res.OldestSegment.IsZero() || segment.Before(s.res.OldestSegment) {
+		s.res.OldestSegment = segment
+	}
+	s.mu.Unlock()
+}
+
+// finish records the elapsed time of the run.
+func (s *runStats) finish() {
+	s.mu.Lock()
+	s.res.Elapsed = time.Since(s.begin)
+	s.mu.Unlock()
+}
+
+// maxSnapshotMerges caps the merges in a snapshot, snapshots are saved in the
+// job documents that can not grow beyond the document size limit of Mongo.
+const maxSnapshotMerges = 100
+
+// snapshot returns a copy of the statistics collected so far with a sample of
+// the merges.
+func (s *runStats) snapshot() *ProcessResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := *s.res
+	res.Merged = make(map[string]int, len(s.res.Merged))
+	for dir, n := range s.res.Merged {
+		res.Merged[dir] = n
+	}
+	merges := s.res.Merges
+	if len(merges) > maxSnapshotMerges {
+		merges = merges[:maxSnapshotMerges]
+	}
+	res.Merges = append([]Merge(nil), merges...)
+
+	if res.Elapsed == 0 {
+		res.Elapsed = time.Since(s.begin)
+	}
+	return &res
+}
+
+// merged counts a member whose hash map is merged and deleted. Written values
+// are nil if there was nothing to write or they were already written.
+func (s *runStats) merged(tenant, dir string, u *mongodb.CompactionUpsert) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.res.Merged[dir]++
+	if u == nil {
+		return
+	}
+
+	s.res.Functions += len(u.Data)
+	for _, st := range u.Data {
+		s.res.Duration += time.Duration(st.Duration)
+	}
+
+	segment, err := strconv.ParseInt(u.Segment, 10, 64)
+	if err != nil {
+		return
+	}
+
+	if s.touched == nil {
+		s.touched = make(map[touch]struct{})
+	}
+	s.touched[touch{tenant: tenant, userID: u.UserID, segment: time.Unix(segment, 0).UTC()}] = struct{}{}
+}
+
+// touches returns the compaction documents that are written in the run.
+func (s *runStats) touches() []touch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	touches := make([]touch, 0, len(s.touched))
+	for t := range s.touched {
+		touches = append(touches, t)
+	}
+	return touches
+}
+
+// deadLettered counts the members that are moved to the dead letters.
+func (s *runStats) deadLettered(n int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.res.DeadLettered += n
+	s.mu.Unlock()
+}
+
+// requeued counts the members that are put back to their queues after an
+// error.
+func (s *runStats) requeued(n int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.res.Requeued += n
+	s.mu.Unlock()
+}
+
+// oldestSegment returns the oldest segment of the given jobs whose queue or
+// processing set still has members.
+func oldestSegment(redisConn *redis.RedisSession, jobs []queueJob) (time.Time, error) {
+	if len(jobs) == 0 {
+		return time.Time{}, nil
+	}
+
+	conn := redisConn.Pool().Get()
+	defer conn.Close()
+
+	for _, job := range jobs {
+		queueName := job.keyNames.CurrentCounterSet
+		if err := conn.Send("SCARD", redisConn.AddPrefix(queueName)); err != nil {
+			return time.Time{}, err
+		}
+		if err := conn.Send("SCARD", redisConn.AddPrefix(queueName+"_processing")); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	replies, err := redigo.Ints(conn.Do(""))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var oldest time.Time
+	for i, job := range jobs {
+		if replies[2*i]+replies[2*i+1] == 0 {
+			continue
+		}
+
+		if oldest.IsZero() || job.segment.Before(oldest) {
+			oldest = job.segment
+		}
+	}
+	return oldest, nil
+}
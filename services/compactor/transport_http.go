@@ -8,6 +8,10 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/ropelive/count/pkg/mongodb"
+	mgo "gopkg.in/mgo.v2"
 )
 
 func decodeProcessRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
@@ -18,6 +22,30 @@ func decodeProcessRequest(_ context.Context, r *http.Request) (request interface
 	return req, nil
 }
 
+func decodeRollupRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req RollupRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeCheckpointsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return CheckpointsRequest{}, nil
+}
+
+func decodeJobRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return JobRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodeDeadLettersRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return DeadLettersRequest{}, nil
+}
+
+func decodeDeadLetterRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return DeadLetterRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
 // errorer is implemented by all concrete response types that may contain
 // errors. It allows us to change the HTTP response code without needing to
 // trigger an endpoint (transport-level) error. For more information, read the
@@ -67,6 +95,10 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 
 func codeFrom(err error) int {
 	switch err {
+	case errInvalidRange, errRangeTooLong, errInvalidDirection, mongodb.ErrUnknownGranularity, mongodb.ErrInvalidJobID:
+		return http.StatusBadRequest
+	case mgo.ErrNotFound, errDeadLetterNotFound:
+		return http.StatusNotFound
 	default:
 		return http.StatusInternalServerError
 	}
@@ -0,0 +1,82 @@
+package compactor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/koding/redis"
+	"github.com/ropelive/count/pkg"
+)
+
+// queueJob is a queue of a segment that is drained by the workers.
+type queueJob struct {
+	segment  time.Time
+	keyNames pkg.KeyNames
+}
+
+// processQueues drains the given queues with the configured number of workers.
+// Every worker goes over all of the queues starting from a different one, so
+// the members of a large queue are processed in parallel too. Members are
+// claimed in batches, so a member is never processed by two workers. First
+// error stops all of the workers.
+func (c *compactorService) processQueues(ctx context.Context, redisConn *redis.RedisSession, jobs []queueJob, member string, stats *runStats) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := c.app.Concurrency()
+	errs := make(chan error, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			for i := range jobs {
+				job := jobs[(offset+i)%len(jobs)]
+				if err := c.drain(ctx, redisConn, job, member, stats); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	// first error is the one that has cancelled the others.
+	return <-errs
+}
+
+// drain processes the members of the queue till it is empty. Only the given
+// member is processed if it is set.
+func (c *compactorService) drain(ctx context.Context, redisConn *redis.RedisSession, job queueJob, member string, stats *runStats) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		var err error
+		if member != "" {
+			err = c.processMember(redisConn, job.keyNames, member, stats)
+		} else {
+			err = c.processBatch(redisConn, job.keyNames, stats)
+		}
+
+		if err == errNotFound {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
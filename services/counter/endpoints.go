@@ -2,14 +2,20 @@ package counter
 
 import (
 	"context"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
+	"github.com/ropelive/count/pkg"
 )
 
 // Endpoints collects all of the endpoints that compose a counter service.
 type Endpoints struct {
-	StartEndpoint endpoint.Endpoint
-	StopEndpoint  endpoint.Endpoint
+	StartEndpoint      endpoint.Endpoint
+	StopEndpoint       endpoint.Endpoint
+	StartBatchEndpoint endpoint.Endpoint
+	StopBatchEndpoint  endpoint.Endpoint
+	RecordEndpoint     endpoint.Endpoint
+	KeysEndpoint       endpoint.Endpoint
 }
 
 // Start implements Service. Primarily useful in a client.
@@ -32,11 +38,58 @@ func (e Endpoints) Stop(ctx context.Context, request StopRequest) (string, error
 	return "", resp.Err
 }
 
+// StartBatch implements Service. Primarily useful in a client.
+func (e Endpoints) StartBatch(ctx context.Context, request []StartRequest) ([]BatchResult, error) {
+	response, err := e.StartBatchEndpoint(ctx, StartBatchRequest(request))
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(BatchResponse)
+	return resp.Results, resp.Err
+}
+
+// StopBatch implements Service. Primarily useful in a client.
+func (e Endpoints) StopBatch(ctx context.Context, request []StopRequest) ([]BatchResult, error) {
+	response, err := e.StopBatchEndpoint(ctx, StopBatchRequest(request))
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(BatchResponse)
+	return resp.Results, resp.Err
+}
+
+// Record implements Service. Primarily useful in a client.
+func (e Endpoints) Record(ctx context.Context, request RecordRequest) (string, error) {
+	response, err := e.RecordEndpoint(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	resp := response.(RecordResponse)
+	return resp.Took, resp.Err
+}
+
+// Keys implements Service. Primarily useful in a client.
+func (e Endpoints) Keys(ctx context.Context, request KeysRequest) (*pkg.JWKS, error) {
+	response, err := e.KeysEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(KeysResponse)
+	return &pkg.JWKS{Keys: resp.Keys}, resp.Err
+}
+
 // StartRequest represents a single Start request.
 type StartRequest struct {
 	Source   string `json:"source"`
 	Target   string `json:"target"`
 	FuncName string `json:"funcName"`
+
+	// Labels holds the optional extra aggregation dimensions, eg: region.
+	// Only the configured label keys are allowed.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Tenant is the namespace of the call. Defaults to the default tenant.
+	Tenant string `json:"tenant,omitempty"`
 }
 
 // StartResponse holds the response data for the Start handler
@@ -59,6 +112,12 @@ func MakeStartEndpoint(s Service) endpoint.Endpoint {
 // StopRequest represents a single Stop request.
 type StopRequest struct {
 	Token string `json:"token"`
+
+	// Outcome is one of success, error or cancelled. Defaults to success.
+	Outcome string `json:"outcome,omitempty"`
+
+	// ErrorClass optionally classifies the error of a failed call.
+	ErrorClass string `json:"errorClass,omitempty"`
 }
 
 // StopResponse holds the response data for the Stop handler
@@ -76,3 +135,109 @@ func MakeStopEndpoint(s Service) endpoint.Endpoint {
 		return StopResponse{Err: e}, nil
 	}
 }
+
+// StartBatchRequest represents multiple Start requests.
+type StartBatchRequest []StartRequest
+
+// StopBatchRequest represents multiple Stop requests.
+type StopBatchRequest []StopRequest
+
+// BatchResult holds the result of a single item in a batch request. Results
+// are in the same order with the requests.
+type BatchResult struct {
+	Token string `json:"token,omitempty"`
+	Took  string `json:"took,omitempty"`
+	Err   string `json:"err,omitempty"`
+}
+
+// BatchResponse holds the response data for the batch handlers
+type BatchResponse struct {
+	Results []BatchResult `json:"results,omitempty"`
+	Err     error         `json:"err,omitempty"`
+}
+
+func (r BatchResponse) error() error { return r.Err }
+
+// MakeStartBatchEndpoint returns an endpoint for the server.
+func MakeStartBatchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(StartBatchRequest)
+		results, e := s.StartBatch(ctx, req)
+		return BatchResponse{Results: results, Err: e}, nil
+	}
+}
+
+// MakeStopBatchEndpoint returns an endpoint for the server.
+func MakeStopBatchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(StopBatchRequest)
+		results, e := s.StopBatch(ctx, req)
+		return BatchResponse{Results: results, Err: e}, nil
+	}
+}
+
+// RecordRequest represents a call that is measured by the caller.
+type RecordRequest struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	FuncName string `json:"funcName"`
+
+	// Duration holds the duration of the call in nano secs.
+	Duration int64 `json:"duration"`
+
+	// Timestamp is the time of the call. Defaults to now. It should be in the
+	// current or the previous segment, calls older than 5 to 10 mins are
+	// rejected as their segments might already be compacted.
+	Timestamp time.Time `json:"timestamp,omitempty"`
+
+	Outcome    string            `json:"outcome,omitempty"`
+	ErrorClass string            `json:"errorClass,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+
+	// Tenant should be empty, records are not authenticated. Calls of the
+	// tenants are recorded with their tokens.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// RecordResponse holds the response data for the Record handler
+type RecordResponse struct {
+	Took string `json:"took,omitempty"`
+	Err  error  `json:"err,omitempty"`
+}
+
+func (r RecordResponse) error() error { return r.Err }
+
+// MakeRecordEndpoint returns an endpoint for the server.
+func MakeRecordEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(RecordRequest)
+		took, e := s.Record(ctx, req)
+		return RecordResponse{Took: took, Err: e}, nil
+	}
+}
+
+// KeysRequest represents a request for the token verification keys.
+type KeysRequest struct {
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// KeysResponse holds the response data for the Keys handler. It is a JSON Web
+// Key Set.
+type KeysResponse struct {
+	Keys []pkg.JWK `json:"keys"`
+	Err  error     `json:"err,omitempty"`
+}
+
+func (r KeysResponse) error() error { return r.Err }
+
+// MakeKeysEndpoint returns an endpoint for the server.
+func MakeKeysEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(KeysRequest)
+		jwks, e := s.Keys(ctx, req)
+		if e != nil {
+			return KeysResponse{Err: e}, nil
+		}
+		return KeysResponse{Keys: jwks.Keys}, nil
+	}
+}
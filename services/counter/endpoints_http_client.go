@@ -24,6 +24,11 @@ func MakeHTTPClientEndpoints(instance string, options ...httptransport.ClientOpt
 	return Endpoints{
 		StartEndpoint: httptransport.NewClient("POST", tgt, encodeStartRequest, decodeStartResponse, options...).Endpoint(),
 		StopEndpoint:  httptransport.NewClient("POST", tgt, encodeStopRequest, decodeStopResponse, options...).Endpoint(),
+
+		StartBatchEndpoint: httptransport.NewClient("POST", tgt, encodeStartBatchRequest, decodeBatchResponse, options...).Endpoint(),
+		StopBatchEndpoint:  httptransport.NewClient("POST", tgt, encodeStopBatchRequest, decodeBatchResponse, options...).Endpoint(),
+		RecordEndpoint:     httptransport.NewClient("POST", tgt, encodeRecordRequest, decodeRecordResponse, options...).Endpoint(),
+		KeysEndpoint:       httptransport.NewClient("GET", tgt, encodeKeysRequest, decodeKeysResponse, options...).Endpoint(),
 	}, nil
 }
 
@@ -37,6 +42,29 @@ func encodeStopRequest(ctx context.Context, req *http.Request, request interface
 	return encodeRequest(ctx, req, request)
 }
 
+func encodeStartBatchRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	req.Method, req.URL.Path = "POST", "/start/batch"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeStopBatchRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	req.Method, req.URL.Path = "POST", "/stop/batch"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeRecordRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	req.Method, req.URL.Path = "POST", "/record"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeKeysRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	req.Method, req.URL.Path = "GET", "/.well-known/jwks.json"
+	if tenant := request.(KeysRequest).Tenant; tenant != "" {
+		req.URL.RawQuery = url.Values{"tenant": {tenant}}.Encode()
+	}
+	return nil
+}
+
 func decodeStartResponse(_ context.Context, resp *http.Response) (interface{}, error) {
 	var response StartResponse
 	err := json.NewDecoder(resp.Body).Decode(&response)
@@ -48,3 +76,21 @@ func decodeStopResponse(_ context.Context, resp *http.Response) (interface{}, er
 	err := json.NewDecoder(resp.Body).Decode(&response)
 	return response, err
 }
+
+func decodeBatchResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response BatchResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeRecordResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response RecordResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeKeysResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response KeysResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
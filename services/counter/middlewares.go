@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/ropelive/count/pkg"
 )
 
 // Middleware describes a service (as opposed to endpoint) middleware.
@@ -34,7 +35,35 @@ func (mw loggingMiddleware) Start(ctx context.Context, p StartRequest) (token st
 
 func (mw loggingMiddleware) Stop(ctx context.Context, p StopRequest) (token string, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "Stop", "source", p.Token, "took", time.Since(begin), "err", err)
+		mw.logger.Log("method", "Stop", "source", p.Token, "outcome", p.Outcome, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	return mw.next.Stop(ctx, p)
 }
+
+func (mw loggingMiddleware) StartBatch(ctx context.Context, ps []StartRequest) (results []BatchResult, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "StartBatch", "count", len(ps), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.StartBatch(ctx, ps)
+}
+
+func (mw loggingMiddleware) StopBatch(ctx context.Context, ps []StopRequest) (results []BatchResult, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "StopBatch", "count", len(ps), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.StopBatch(ctx, ps)
+}
+
+func (mw loggingMiddleware) Record(ctx context.Context, p RecordRequest) (took string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "Record", "source", p.Source, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.Record(ctx, p)
+}
+
+func (mw loggingMiddleware) Keys(ctx context.Context, p KeysRequest) (jwks *pkg.JWKS, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "Keys", "tenant", p.Tenant, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.Keys(ctx, p)
+}
@@ -35,5 +35,33 @@ func MakeHTTPHandler(s Service, logger log.Logger) http.Handler {
 		options...,
 	))
 
+	r.Methods("POST").Path("/start/batch").Handler(httptransport.NewServer(
+		MakeStartBatchEndpoint(s),
+		decodeStartBatchRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/stop/batch").Handler(httptransport.NewServer(
+		MakeStopBatchEndpoint(s),
+		decodeStopBatchRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/record").Handler(httptransport.NewServer(
+		MakeRecordEndpoint(s),
+		decodeRecordRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/.well-known/jwks.json").Handler(httptransport.NewServer(
+		MakeKeysEndpoint(s),
+		decodeKeysRequest,
+		encodeResponse,
+		options...,
+	))
+
 	return r
 }
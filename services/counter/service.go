@@ -2,15 +2,67 @@ package counter
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
+	redigo "github.com/garyburd/redigo/redis"
 	"github.com/ropelive/count/pkg"
 )
 
+// recordScript increments the total duration, the call count and the latency
+// bucket of a function and keeps track of its min and max durations in the
+// given hash.
+//
+// KEYS[1] hash name, ARGV[1] duration field, ARGV[2] calls field, ARGV[3] min
+// field, ARGV[4] max field, ARGV[5] duration, ARGV[6] latency bucket field,
+// ARGV[7] outcome field, ARGV[8] error class field, can be empty.
+const recordScript = `
+local dur = tonumber(ARGV[5])
+redis.call("HINCRBY", KEYS[1], ARGV[1], dur)
+redis.call("HINCRBY", KEYS[1], ARGV[2], 1)
+redis.call("HINCRBY", KEYS[1], ARGV[6], 1)
+redis.call("HINCRBY", KEYS[1], ARGV[7], 1)
+if ARGV[8] ~= "" then
+	redis.call("HINCRBY", KEYS[1], ARGV[8], 1)
+end
+local min = tonumber(redis.call("HGET", KEYS[1], ARGV[3]))
+if not min or dur < min then
+	redis.call("HSET", KEYS[1], ARGV[3], dur)
+end
+local max = tonumber(redis.call("HGET", KEYS[1], ARGV[4]))
+if not max or dur > max then
+	redis.call("HSET", KEYS[1], ARGV[4], dur)
+end
+return 1
+`
+
+// labelScript adds the label value to the segment's value set of the label
+// key unless the set is full. Returns the value that should be recorded. It is
+// used for capping the error classes of a function too.
+//
+// KEYS[1] label values set, ARGV[1] label value, ARGV[2] max values, ARGV[3]
+// other value, ARGV[4] set expiry in secs.
+const labelScript = `
+if redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 1 then
+	return ARGV[1]
+end
+if redis.call("SCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+	return ARGV[3]
+end
+redis.call("SADD", KEYS[1], ARGV[1])
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+return ARGV[1]
+`
+
 // Service is the interface for counter operations.
 type Service interface {
 	Start(ctx context.Context, p StartRequest) (string, error)
 	Stop(ctx context.Context, p StopRequest) (string, error)
+	StartBatch(ctx context.Context, ps []StartRequest) ([]BatchResult, error)
+	StopBatch(ctx context.Context, ps []StopRequest) ([]BatchResult, error)
+	Record(ctx context.Context, p RecordRequest) (string, error)
+	Keys(ctx context.Context, p KeysRequest) (*pkg.JWKS, error)
 }
 
 type counterService struct {
@@ -25,21 +77,37 @@ func NewService(app *pkg.App) Service {
 }
 
 func (c *counterService) Start(ctx context.Context, p StartRequest) (string, error) {
+	if err := pkg.ValidateFuncName(p.FuncName); err != nil {
+		return "", err
+	}
+
+	if err := c.app.LabelConfig().Validate(p.Labels); err != nil {
+		return "", err
+	}
+
+	keys, err := c.app.Tenants().KeyRing(p.Tenant)
+	if err != nil {
+		return "", err
+	}
+
 	// Create the Claims
 	claims := &pkg.JWTData{
-		Source:   p.Source,
-		Target:   p.Target,
-		FuncName: p.FuncName,
+		Source:    p.Source,
+		Target:    p.Target,
+		FuncName:  p.FuncName,
+		Labels:    p.Labels,
+		Tenant:    p.Tenant,
+		ExpiresAt: time.Now().UTC().Add(c.app.TokenConfig().TTL),
 	}
 
-	tokenString, err := pkg.SignJWT(claims)
+	tokenString, err := pkg.SignJWT(keys.Active(), claims)
 	if err != nil {
 		return "", err
 	}
 
 	c.app.Logger.Log("signedstring", tokenString)
 
-	claims2, err := pkg.ParseJWT(c.app.Logger, tokenString)
+	claims2, err := pkg.ParseJWT(c.app.Logger, c.app.Tenants(), tokenString)
 	if err != nil {
 		return "", err
 	}
@@ -48,52 +116,501 @@ func (c *counterService) Start(ctx context.Context, p StartRequest) (string, err
 	return tokenString, nil
 }
 
+// ErrAlreadyStopped is returned when a token is stopped more than once.
+var ErrAlreadyStopped = errors.New("token is already stopped")
+
 func (c *counterService) Stop(ctx context.Context, p StopRequest) (string, error) {
-	c.app.Logger.Log("signedstring", p.Token)
+	cl, err := c.parseStop(p)
+	if err != nil {
+		return "", err
+	}
 
-	claims, err := pkg.ParseJWT(c.app.Logger, p.Token)
+	claimErrs, err := c.claim(cl)
 	if err != nil {
 		return "", err
 	}
 
+	if claimErrs[0] != nil {
+		return "", claimErrs[0]
+	}
+
+	if err := c.record(cl); err != nil {
+		c.release(cl)
+		return "", err
+	}
+
+	return cl.dur.String(), nil
+}
+
+// StartBatch creates a token for every item in the batch.
+func (c *counterService) StartBatch(ctx context.Context, ps []StartRequest) ([]BatchResult, error) {
+	if err := validateBatchSize(len(ps)); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(ps))
+	for i, p := range ps {
+		token, err := c.Start(ctx, p)
+		if err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		results[i].Token = token
+	}
+
+	return results, nil
+}
+
+// StopBatch records every valid item in the batch with a single redis
+// transaction. Invalid items are reported in their results.
+func (c *counterService) StopBatch(ctx context.Context, ps []StopRequest) ([]BatchResult, error) {
+	if err := validateBatchSize(len(ps)); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(ps))
+	calls := make([]*call, 0, len(ps))
+	indexes := make([]int, 0, len(ps))
+	for i, p := range ps {
+		cl, err := c.parseStop(p)
+		if err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		calls = append(calls, cl)
+		indexes = append(indexes, i)
+	}
+
+	if len(calls) == 0 {
+		return results, nil
+	}
+
+	claimErrs, err := c.claim(calls...)
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := make([]*call, 0, len(calls))
+	claimedIndexes := make([]int, 0, len(calls))
+	for j, i := range indexes {
+		if claimErrs[j] != nil {
+			results[i].Err = claimErrs[j].Error()
+			continue
+		}
+		claimed = append(claimed, calls[j])
+		claimedIndexes = append(claimedIndexes, i)
+	}
+
+	if len(claimed) == 0 {
+		return results, nil
+	}
+
+	err = c.record(claimed...)
+	if err != nil {
+		c.release(claimed...)
+	}
+
+	for j, i := range claimedIndexes {
+		if err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		results[i].Took = claimed[j].dur.String()
+	}
+
+	return results, nil
+}
+
+const (
+	// maxRecordDuration limits the duration of the pre-measured calls.
+	maxRecordDuration = 24 * time.Hour
+
+	// maxClockSkew is the allowed difference for the timestamps in the future.
+	maxClockSkew = time.Minute
+)
+
+// ErrUnauthenticatedTenant is returned when a tenant's call is recorded without
+// a token of the tenant.
+var ErrUnauthenticatedTenant = errors.New("calls of tenants should be recorded with their tokens")
+
+// errRecordTooOld is returned for the timestamps that fall into the segments
+// that can already be compacted. Only the current and the previous segments
+// are accepted, so the calls of the last 5 to 10 mins can be recorded. Older
+// calls are not backfilled.
+var errRecordTooOld = fmt.Errorf("timestamp should be in the current or the previous %s segment, older calls are not recorded", pkg.SegmentDur)
+
+// errRecordInFuture is returned for the timestamps that are ahead of the
+// clock more than maxClockSkew.
+var errRecordInFuture = fmt.Errorf("timestamp should not be more than %s in the future", maxClockSkew)
+
+// Record records a call that is measured by the caller, without a token.
+func (c *counterService) Record(ctx context.Context, p RecordRequest) (string, error) {
+	if p.Source == "" || p.Target == "" || p.FuncName == "" {
+		return "", errors.New("source, target and funcName should be set")
+	}
+
+	if err := pkg.ValidateFuncName(p.FuncName); err != nil {
+		return "", err
+	}
+
+	dur := time.Duration(p.Duration)
+	if dur < 0 || dur > maxRecordDuration {
+		return "", fmt.Errorf("duration should be between 0 and %s", maxRecordDuration)
+	}
+
+	now := time.Now().UTC()
+	at := now
+	if !p.Timestamp.IsZero() {
+		at = p.Timestamp.UTC()
+	}
+
+	// segments are compacted once they are processible, records of them would
+	// not be picked up by the compactor.
+	if !pkg.GetSegment(at).After(pkg.GetLastProcessibleSegment(now)) {
+		return "", errRecordTooOld
+	}
+
+	if at.After(now.Add(maxClockSkew)) {
+		return "", errRecordInFuture
+	}
+
+	if p.Outcome == "" {
+		p.Outcome = pkg.OutcomeSuccess
+	}
+
+	if err := pkg.ValidateOutcome(p.Outcome, p.ErrorClass); err != nil {
+		return "", err
+	}
+
+	if err := c.app.LabelConfig().Validate(p.Labels); err != nil {
+		return "", err
+	}
+
+	// anyone can record, so records can not be trusted with a tenant.
+	if p.Tenant != "" {
+		return "", ErrUnauthenticatedTenant
+	}
+
+	err := c.record(&call{
+		source:     p.Source,
+		target:     p.Target,
+		funcName:   p.FuncName,
+		labels:     p.Labels,
+		dur:        dur,
+		outcome:    p.Outcome,
+		errorClass: p.ErrorClass,
+		segment:    pkg.GetSegment(at),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return dur.String(), nil
+}
+
+// Keys returns the public keys that can be used to verify the tokens.
+func (c *counterService) Keys(ctx context.Context, p KeysRequest) (*pkg.JWKS, error) {
+	keys, err := c.app.Tenants().KeyRing(p.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	return keys.JWKS(), nil
+}
+
+// maxBatchSize limits the item count of the batch requests.
+const maxBatchSize = 1000
+
+var errBatchSize = fmt.Errorf("batch should have between 1 and %d items", maxBatchSize)
+
+func validateBatchSize(n int) error {
+	if n == 0 || n > maxBatchSize {
+		return errBatchSize
+	}
+	return nil
+}
+
+// call holds a measured call that is ready to be recorded.
+type call struct {
+	// tokenID and expiresAt are only set for the calls that are started
+	// with a token.
+	tokenID   string
+	expiresAt time.Time
+
+	tenant     string
+	source     string
+	target     string
+	funcName   string
+	labels     map[string]string
+	dur        time.Duration
+	outcome    string
+	errorClass string
+	segment    time.Time
+}
+
+// parseStop validates the stop request and calculates the duration of the
+// call from its token.
+func (c *counterService) parseStop(p StopRequest) (*call, error) {
+	c.app.Logger.Log("signedstring", p.Token)
+
+	if p.Outcome == "" {
+		p.Outcome = pkg.OutcomeSuccess
+	}
+
+	if err := pkg.ValidateOutcome(p.Outcome, p.ErrorClass); err != nil {
+		return nil, err
+	}
+
+	claims, err := pkg.ParseJWT(c.app.Logger, c.app.Tenants(), p.Token)
+	if err != nil {
+		return nil, err
+	}
+
 	dur := time.Now().UTC().Sub(claims.CreatedAt)
 	c.app.Logger.Log("took", dur.String())
 
+	if tokens := c.app.TokenConfig(); dur > tokens.MaxCallDuration {
+		switch tokens.OverlongPolicy {
+		case pkg.OverlongClamp:
+			dur = tokens.MaxCallDuration
+		case pkg.OverlongTimeout:
+			dur = tokens.MaxCallDuration
+			p.Outcome, p.ErrorClass = pkg.OutcomeTimeout, ""
+		default:
+			return nil, pkg.ErrCallTooLong
+		}
+	}
+
+	return &call{
+		tokenID:    claims.ID,
+		expiresAt:  claims.ExpiresAt,
+		tenant:     claims.Tenant,
+		source:     claims.Source,
+		target:     claims.Target,
+		funcName:   claims.FuncName,
+		labels:     claims.Labels,
+		dur:        dur,
+		outcome:    p.Outcome,
+		errorClass: p.ErrorClass,
+		segment:    pkg.GetCurrentSegment(),
+	}, nil
+}
+
+// claim marks the tokens of the given calls as stopped with a single
+// pipeline. Returns ErrAlreadyStopped for the calls whose tokens are already
+// stopped. Claims expire together with their tokens.
+func (c *counterService) claim(calls ...*call) ([]error, error) {
 	redisConn := c.app.MustGetRedis()
 	conn := redisConn.Pool().Get()
 	defer conn.Close()
 
-	segment := pkg.GetCurrentSegment()
-	keyNames := pkg.GenerateKeyNames(segment)
-	currentSrcHSet := keyNames.Src.HashSetName(claims.Source)
-	currentDstHSet := keyNames.Dst.HashSetName(claims.Target)
+	redisConn.SetPrefix("ropecount")
+	for _, cl := range calls {
+		// give some room for the clock differences, exp is in secs anyway.
+		ttl := c.app.TokenConfig().TTL
+		if !cl.expiresAt.IsZero() {
+			ttl = time.Until(cl.expiresAt) + time.Minute
+		}
+
+		key := redisConn.AddPrefix(pkg.StoppedTokenKey(cl.tokenID))
+		if err := conn.Send("SET", key, 1, "PX", int64(ttl/time.Millisecond), "NX"); err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := redigo.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(calls))
+	for i, reply := range replies {
+		switch reply := reply.(type) {
+		case nil:
+			errs[i] = ErrAlreadyStopped
+		case redigo.Error:
+			errs[i] = reply
+		}
+	}
+
+	return errs, nil
+}
+
+// release removes the stopped marks of the given calls, so they can be
+// stopped again after a failed record.
+func (c *counterService) release(calls ...*call) {
+	redisConn := c.app.MustGetRedis()
+	keys := make([]interface{}, len(calls))
+	for i, cl := range calls {
+		keys[i] = pkg.StoppedTokenKey(cl.tokenID)
+	}
+
+	if _, err := redisConn.Del(keys...); err != nil {
+		c.app.ErrorLog("msg", "could not release the stopped tokens", "err", err.Error())
+	}
+}
+
+// record writes the given calls into their segments with a single pipelined
+// redis transaction.
+func (c *counterService) record(calls ...*call) error {
+	redisConn := c.app.MustGetRedis()
+	conn := redisConn.Pool().Get()
+	defer conn.Close()
 
 	redisConn.SetPrefix("ropecount")
+	if err := c.capCalls(conn, calls); err != nil {
+		return err
+	}
+
 	// We dont need to DISCARD on error cases. Conn.Close already handles them.
 	// For futher info see pool.go/pooledConnection::Close()
-	if _, err := conn.Do("MULTI"); err != nil {
-		return "", err
+	if err := conn.Send("MULTI"); err != nil {
+		return err
 	}
 
-	if _, err := conn.Do("SADD", redisConn.AddPrefix(keyNames.Src.CurrentCounterSet), claims.Source); err != nil {
-		return "", err
+	for _, cl := range calls {
+		keyNames := pkg.GenerateKeyNames(cl.tenant, cl.segment)
+		currentSrcHSet := keyNames.Src.HashSetName(cl.source)
+		currentDstHSet := keyNames.Dst.HashSetName(cl.target)
+
+		if cl.tenant != "" {
+			if err := conn.Send("SADD", redisConn.AddPrefix(pkg.TenantsSetName), cl.tenant); err != nil {
+				return err
+			}
+		}
+
+		if err := conn.Send("SADD", redisConn.AddPrefix(keyNames.Src.CurrentCounterSet), cl.source); err != nil {
+			return err
+		}
+
+		if err := conn.Send("SADD", redisConn.AddPrefix(keyNames.Dst.CurrentCounterSet), cl.target); err != nil {
+			return err
+		}
+
+		if err := conn.Send("EVAL", c.recordArgs(redisConn.AddPrefix(currentSrcHSet), cl)...); err != nil {
+			return err
+		}
+
+		if err := conn.Send("EVAL", c.recordArgs(redisConn.AddPrefix(currentDstHSet), cl)...); err != nil {
+			return err
+		}
 	}
 
-	if _, err := conn.Do("SADD", redisConn.AddPrefix(keyNames.Dst.CurrentCounterSet), claims.Target); err != nil {
-		return "", err
+	// errors of the commands in the transaction are returned in its replies.
+	replies, err := redigo.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
 	}
 
-	if _, err := conn.Do("HINCRBY", redisConn.AddPrefix(currentSrcHSet), claims.FuncName, int64(dur)); err != nil {
-		return "", err
+	for _, reply := range replies {
+		if err, ok := reply.(redigo.Error); ok {
+			return err
+		}
 	}
 
-	if _, err := conn.Do("HINCRBY", redisConn.AddPrefix(currentDstHSet), claims.FuncName, int64(dur)); err != nil {
-		return "", err
+	return nil
+}
+
+// capSetTTL keeps the sets of the capped values till their segments are
+// compacted.
+const capSetTTL = 4 * pkg.SegmentDur
+
+// cappedValue is a value of a call that is capped per segment, see
+// labelScript.
+type cappedValue struct {
+	setName string
+	value   string
+	max     int
+	other   string
+
+	// set replaces the value of the call with the capped value.
+	set func(value string)
+}
+
+// capCalls replaces the label values and the error classes of the given calls
+// with pkg.OtherLabelValue and pkg.OtherErrorClass if their segments already
+// have too many distinct values for the label keys and the functions.
+func (c *counterService) capCalls(conn redigo.Conn, calls []*call) error {
+	maxLabelValues := c.app.LabelConfig().MaxValuesPerSegment
+
+	var values []cappedValue
+	for _, cl := range calls {
+		if len(cl.labels) != 0 {
+			labels := make(map[string]string, len(cl.labels))
+			for key, val := range cl.labels {
+				key := key
+				values = append(values, cappedValue{
+					setName: pkg.LabelValuesSetName(cl.tenant, cl.segment, key),
+					value:   val,
+					max:     maxLabelValues,
+					other:   pkg.OtherLabelValue,
+					set:     func(value string) { labels[key] = value },
+				})
+			}
+			cl.labels = labels
+		}
+
+		if cl.errorClass != "" {
+			cl := cl
+			values = append(values, cappedValue{
+				setName: pkg.ErrorClassesSetName(cl.tenant, cl.segment, cl.funcName),
+				value:   cl.errorClass,
+				max:     pkg.MaxErrorClassesPerSegment,
+				other:   pkg.OtherErrorClass,
+				set:     func(value string) { cl.errorClass = value },
+			})
+		}
 	}
 
-	if _, err := conn.Do("EXEC"); err != nil {
-		return "", err
+	return c.capValues(conn, values)
+}
+
+// capValues caps the given values with a single pipeline.
+func (c *counterService) capValues(conn redigo.Conn, values []cappedValue) error {
+	if len(values) == 0 {
+		return nil
 	}
 
-	return dur.String(), nil
+	redisConn := c.app.MustGetRedis()
+	expiry := int64(capSetTTL / time.Second)
+	for _, v := range values {
+		if err := conn.Send("EVAL", labelScript, 1, redisConn.AddPrefix(v.setName), v.value, v.max, v.other, expiry); err != nil {
+			return err
+		}
+	}
+
+	capped, err := redigo.Strings(conn.Do(""))
+	if err != nil {
+		return err
+	}
+
+	for i, v := range values {
+		v.set(capped[i])
+	}
+
+	return nil
+}
+
+// recordArgs prepares the EVAL arguments of recordScript. Fields are
+// generated for the series of the call, so labels are aggregated separately.
+func (c *counterService) recordArgs(hashName string, cl *call) []interface{} {
+	series := pkg.SeriesName(cl.funcName, cl.labels)
+
+	errorClassField := ""
+	if cl.errorClass != "" {
+		errorClassField = pkg.FieldName(series, pkg.MetricErrorClassPrefix+cl.errorClass)
+	}
+
+	return []interface{}{
+		recordScript,
+		1,
+		hashName,
+		pkg.FieldName(series, pkg.MetricDuration),
+		pkg.FieldName(series, pkg.MetricCalls),
+		pkg.FieldName(series, pkg.MetricMin),
+		pkg.FieldName(series, pkg.MetricMax),
+		int64(cl.dur),
+		pkg.FieldName(series, pkg.BucketMetric(c.app.LatencyBuckets(), cl.dur)),
+		pkg.FieldName(series, pkg.MetricOutcomePrefix+cl.outcome),
+		errorClassField,
+	}
 }
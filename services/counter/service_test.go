@@ -0,0 +1,269 @@
+package counter
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/koding/redis"
+	"github.com/ropelive/count/pkg"
+)
+
+func withApp(fn func(app *pkg.App)) {
+	name := "counter_test"
+	app := pkg.NewApp(name, pkg.ConfigureHTTP(), pkg.ConfigureRedis())
+	fn(app)
+}
+
+func randomName(prefix string) string {
+	return prefix + strconv.Itoa(rand.Int())
+}
+
+// cleanup removes the keys that are written by the calls of the given source
+// and target in the current segment.
+func cleanup(redisConn *redis.RedisSession, source, target string) {
+	redisConn.SetPrefix("ropecount")
+	keyNames := pkg.GenerateKeyNames("", pkg.GetCurrentSegment())
+	redisConn.Del(keyNames.Src.HashSetName(source), keyNames.Dst.HashSetName(target))
+	redisConn.RemoveSetMembers(keyNames.Src.CurrentCounterSet, source)
+	redisConn.RemoveSetMembers(keyNames.Dst.CurrentCounterSet, target)
+}
+
+func Test_counterService_claim(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		rand.Seed(time.Now().UnixNano())
+		c := &counterService{app: app}
+
+		cl := &call{tokenID: randomName("token")}
+		defer app.MustGetRedis().Del(pkg.StoppedTokenKey(cl.tokenID))
+
+		errs, err := c.claim(cl, cl)
+		if err != nil {
+			t.Fatalf("counterService.claim() error = %v", err)
+		}
+		if errs[0] != nil || errs[1] != ErrAlreadyStopped {
+			t.Fatalf("counterService.claim() errs = %v, want [<nil> %v]", errs, ErrAlreadyStopped)
+		}
+
+		errs, err = c.claim(cl)
+		if err != nil || errs[0] != ErrAlreadyStopped {
+			t.Fatalf("counterService.claim() = %v, %v, want %v", errs, err, ErrAlreadyStopped)
+		}
+
+		c.release(cl)
+
+		errs, err = c.claim(cl)
+		if err != nil || errs[0] != nil {
+			t.Fatalf("counterService.claim() after release = %v, %v, want no errors", errs, err)
+		}
+	})
+}
+
+func Test_counterService_StopBatch(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		rand.Seed(time.Now().UnixNano())
+		c := &counterService{app: app}
+		ctx := context.Background()
+
+		source, target := randomName("source"), randomName("target")
+		defer cleanup(app.MustGetRedis(), source, target)
+
+		starts, err := c.StartBatch(ctx, []StartRequest{
+			{Source: source, Target: target, FuncName: "fn1"},
+			{Source: source, Target: target, FuncName: "fn2"},
+		})
+		if err != nil {
+			t.Fatalf("counterService.StartBatch() error = %v", err)
+		}
+
+		results, err := c.StopBatch(ctx, []StopRequest{
+			{Token: starts[0].Token},
+			{Token: starts[0].Token},
+			{Token: starts[1].Token, Outcome: pkg.OutcomeError, ErrorClass: "timeout"},
+			{Token: "invalid"},
+			{Token: starts[1].Token, Outcome: "unknown"},
+		})
+		if err != nil {
+			t.Fatalf("counterService.StopBatch() error = %v", err)
+		}
+
+		if results[0].Took == "" || results[0].Err != "" {
+			t.Errorf("first stop = %+v, want took", results[0])
+		}
+		if results[1].Err != ErrAlreadyStopped.Error() {
+			t.Errorf("same token stop = %+v, want %v", results[1], ErrAlreadyStopped)
+		}
+		if results[2].Took == "" || results[2].Err != "" {
+			t.Errorf("second token stop = %+v, want took", results[2])
+		}
+		for _, i := range []int{3, 4} {
+			if results[i].Took != "" || results[i].Err == "" {
+				t.Errorf("invalid stop %d = %+v, want error", i, results[i])
+			}
+		}
+
+		if _, err := c.Stop(ctx, StopRequest{Token: starts[1].Token}); err != ErrAlreadyStopped {
+			t.Errorf("counterService.Stop() error = %v, want %v", err, ErrAlreadyStopped)
+		}
+	})
+}
+
+func Test_counterService_Stop_release(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		rand.Seed(time.Now().UnixNano())
+		c := &counterService{app: app}
+		ctx := context.Background()
+
+		source, target := randomName("source"), randomName("target")
+		defer cleanup(app.MustGetRedis(), source, target)
+
+		token, err := c.Start(ctx, StartRequest{Source: source, Target: target, FuncName: "fn"})
+		if err != nil {
+			t.Fatalf("counterService.Start() error = %v", err)
+		}
+
+		// a string in place of the hash map of the source fails the record.
+		redisConn := app.MustGetRedis()
+		redisConn.SetPrefix("ropecount")
+		srcHSet := pkg.GenerateKeyNames("", pkg.GetCurrentSegment()).Src.HashSetName(source)
+		if _, err := redisConn.Do("SET", redisConn.AddPrefix(srcHSet), "x"); err != nil {
+			t.Fatalf("SET error = %v", err)
+		}
+
+		if _, err := c.Stop(ctx, StopRequest{Token: token}); err == nil {
+			t.Fatal("counterService.Stop() error = nil, want the record error")
+		}
+
+		if _, err := redisConn.Del(srcHSet); err != nil {
+			t.Fatalf("Del error = %v", err)
+		}
+
+		if _, err := c.Stop(ctx, StopRequest{Token: token}); err != nil {
+			t.Fatalf("counterService.Stop() after the failed record error = %v", err)
+		}
+
+		if _, err := c.Stop(ctx, StopRequest{Token: token}); err != ErrAlreadyStopped {
+			t.Fatalf("counterService.Stop() error = %v, want %v", err, ErrAlreadyStopped)
+		}
+	})
+}
+
+func Test_counterService_Record(t *testing.T) {
+	withApp(func(app *pkg.App) {
+		rand.Seed(time.Now().UnixNano())
+		c := &counterService{app: app}
+
+		source, target := randomName("source"), randomName("target")
+		defer cleanup(app.MustGetRedis(), source, target)
+
+		now := time.Now().UTC()
+		tests := []struct {
+			name    string
+			p       RecordRequest
+			wantErr error
+		}{
+			{
+				name: "now",
+				p:    RecordRequest{Timestamp: now},
+			},
+			{
+				name: "without timestamp",
+				p:    RecordRequest{},
+			},
+			{
+				name:    "compacted segment",
+				p:       RecordRequest{Timestamp: now.Add(-time.Hour)},
+				wantErr: errRecordTooOld,
+			},
+			{
+				name:    "in the future",
+				p:       RecordRequest{Timestamp: now.Add(2 * maxClockSkew)},
+				wantErr: errRecordInFuture,
+			},
+			{
+				name:    "with tenant",
+				p:       RecordRequest{Tenant: "tenant"},
+				wantErr: ErrUnauthenticatedTenant,
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tt.p.Source, tt.p.Target, tt.p.FuncName = source, target, "fn"
+				tt.p.Duration = int64(time.Millisecond)
+
+				_, err := c.Record(context.Background(), tt.p)
+				if err != tt.wantErr {
+					t.Errorf("counterService.Record() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			})
+		}
+	})
+}
+
+func Test_counterService_capCalls(t *testing.T) {
+	os.Setenv("LABEL_KEYS", "region")
+	os.Setenv("LABEL_MAX_VALUES", "2")
+	defer os.Unsetenv("LABEL_KEYS")
+	defer os.Unsetenv("LABEL_MAX_VALUES")
+
+	app := pkg.NewApp("counter_test", pkg.ConfigureHTTP(), pkg.ConfigureRedis(), pkg.ConfigureLabels())
+
+	var redisConn *redis.RedisSession
+	{
+		redisConn = app.MustGetRedis()
+		rand.Seed(time.Now().UnixNano())
+		redisConn.SetPrefix(strconv.Itoa(rand.Int()))
+	}
+
+	c := &counterService{app: app}
+	segment := pkg.GetCurrentSegment()
+
+	var calls []*call
+	for _, region := range []string{"a", "b", "c", "a"} {
+		calls = append(calls, &call{
+			funcName: "fn",
+			labels:   map[string]string{"region": region},
+			segment:  segment,
+		})
+	}
+
+	for i := 0; i <= pkg.MaxErrorClassesPerSegment; i++ {
+		calls = append(calls, &call{
+			funcName:   "fn",
+			errorClass: "class" + strconv.Itoa(i),
+			segment:    segment,
+		})
+	}
+
+	conn := redisConn.Pool().Get()
+	defer conn.Close()
+
+	if err := c.capCalls(conn, calls); err != nil {
+		t.Fatalf("counterService.capCalls() error = %v", err)
+	}
+
+	defer redisConn.Del(
+		pkg.LabelValuesSetName("", segment, "region"),
+		pkg.ErrorClassesSetName("", segment, "fn"),
+	)
+
+	for i, want := range []string{"a", "b", pkg.OtherLabelValue, "a"} {
+		if got := calls[i].labels["region"]; got != want {
+			t.Errorf("label of call %d = %q, want %q", i, got, want)
+		}
+	}
+
+	for i, cl := range calls[4:] {
+		want := "class" + strconv.Itoa(i)
+		if i == pkg.MaxErrorClassesPerSegment {
+			want = pkg.OtherErrorClass
+		}
+
+		if cl.errorClass != want {
+			t.Errorf("error class of call %d = %q, want %q", i, cl.errorClass, want)
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/ropelive/count/pkg"
 )
 
 func decodeStartRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
@@ -26,6 +28,34 @@ func decodeStopRequest(_ context.Context, r *http.Request) (request interface{},
 	return req, nil
 }
 
+func decodeStartBatchRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req StartBatchRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeStopBatchRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req StopBatchRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeRecordRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req RecordRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeKeysRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return KeysRequest{Tenant: r.URL.Query().Get("tenant")}, nil
+}
+
 // errorer is implemented by all concrete response types that may contain
 // errors. It allows us to change the HTTP response code without needing to
 // trigger an endpoint (transport-level) error. For more information, read the
@@ -75,6 +105,16 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 
 func codeFrom(err error) int {
 	switch err {
+	case pkg.ErrTokenExpired:
+		return http.StatusUnauthorized
+	case ErrUnauthenticatedTenant:
+		return http.StatusForbidden
+	case pkg.ErrCallTooLong:
+		return http.StatusUnprocessableEntity
+	case ErrAlreadyStopped:
+		return http.StatusConflict
+	case pkg.ErrUnknownTenant:
+		return http.StatusNotFound
 	default:
 		return http.StatusBadRequest
 	}